@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/process"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+)
+
+// Load procfly.yml again, so that its templates can be rendered, and then
+// its differences from the running configuration applied to the supervisor.
+func reloadProcflyFile(rndr *render.Renderer, paths file.Paths) (*ProcflyFile, error) {
+	next, err := loadProcflyFile(paths.ProcflyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateNames(paths, next); err != nil {
+		return nil, err
+	}
+
+	// Commands may use the library too
+	if err := rndr.Library(next.templateLibrary()...); err != nil {
+		return nil, configError{Path: []string{"template_library"}, Err: err}
+	}
+	return next, nil
+}
+
+// Register everything in conf with the supervisor, and remove anything that
+// was only in prev. The supervisor leaves alone any process whose rendered
+// command and spec haven't changed. Templates need no special handling, since
+// they're all rendered on every refresh. Anything whose when condition is
+// false is removed, as are leader only processes unless this instance is
+// the leader.
+func apply(svisor process.Supervisor, rndr *render.Renderer, prev, conf *ProcflyFile, leader bool) error {
+	// Render everything up front, so that an error
+	// leaves the supervisor untouched.
+	enabled, err := conf.enabled(rndr, leader)
+	if err != nil {
+		return err
+	}
+
+	// Only what's enabled is rendered, since a command that won't be
+	// registered may well fail, say on a variable that's missing in
+	// strict mode.
+	inits, err := rndr.Commands(commandTemplates(onlyEnabled(enabled, "init", conf.Init)))
+	if err != nil {
+		return err
+	}
+
+	procs, err := renderProcesses(rndr, onlyEnabled(enabled, "processes", conf.Processes))
+	if err != nil {
+		return err
+	}
+
+	reloaders, err := rndr.Commands(commandTemplates(onlyEnabled(enabled, "reload", conf.Reloaders)))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range removed(prev.Init, conf.Init) {
+		svisor.RemoveInit(name)
+	}
+	for _, name := range removed(prev.Processes, conf.Processes) {
+		svisor.RemoveProcess(name)
+	}
+	for _, name := range removed(prev.Reloaders, conf.Reloaders) {
+		svisor.RemoveReload(name)
+	}
+
+	for _, name := range util.StableIter(conf.Init) {
+		if cmd, ok := inits[name]; ok {
+			svisor.RegisterInit(name, cmd)
+		} else {
+			svisor.RemoveInit(name)
+		}
+	}
+	for _, name := range util.StableIter(conf.Processes) {
+		if proc, ok := procs[name]; ok {
+			svisor.RegisterProcess(name, proc)
+		} else {
+			svisor.RemoveProcess(name)
+		}
+	}
+	for _, name := range util.StableIter(conf.Reloaders) {
+		if cmd, ok := reloaders[name]; ok {
+			svisor.RegisterReload(name, cmd)
+		} else {
+			svisor.RemoveReload(name)
+		}
+	}
+	return nil
+}
+
+// Returns the specs in the section that are enabled
+func onlyEnabled[V any](enabled map[string]bool, section string, specs map[string]V) map[string]V {
+	res := make(map[string]V, len(specs))
+	for name, spec := range specs {
+		if enabled[section+"."+name] {
+			res[name] = spec
+		}
+	}
+	return res
+}
+
+// Returns the keys of prev that aren't in next
+func removed[V any](prev, next map[string]V) []string {
+	var names []string
+	for _, name := range util.StableIter(prev) {
+		if _, ok := next[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestApplyDisabled(t *testing.T) {
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), render.Vars{Env: render.EnvVars{}})
+	rndr.SetStrict(true)
+
+	// The disabled commands would fail on their missing keys
+	conf := &ProcflyFile{
+		Init: map[string]CommandSpec{
+			"migrate": {Command: "migrate {{ .Env.DATABASE_URL }}", When: "false"},
+		},
+		Processes: map[string]ProcessSpec{
+			"nats":   {Command: "nats-server"},
+			"backup": {Command: "backup {{ .Env.BACKUP_BUCKET }}", LeaderOnly: true},
+			"debug":  {Command: "debug {{ .Env.DEBUG_PORT }}", When: `{{ hasKey .Env "DEBUG_PORT" }}`},
+		},
+		Reloaders: map[string]CommandSpec{
+			"nats": {Command: "nats-server --signal reload"},
+		},
+	}
+
+	svisor := new(fakeSupervisor)
+	if err := apply(svisor, rndr, new(ProcflyFile), conf, false); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"processes.nats": true, "reload.nats": true}
+	if !reflect.DeepEqual(svisor.registered, want) {
+		t.Errorf("expected %v to be registered, got %v", want, svisor.registered)
+	}
+
+	// Once it's enabled, the missing key fails, leaving the supervisor untouched
+	if err := apply(svisor, rndr, conf, conf, true); err == nil {
+		t.Error("expected the leader only process to fail")
+	}
+	if !reflect.DeepEqual(svisor.registered, want) {
+		t.Errorf("expected %v to still be registered, got %v", want, svisor.registered)
+	}
+}
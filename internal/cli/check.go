@@ -0,0 +1,386 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/process"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+type CheckCmd struct {
+	ProcflyDir string `arg:"" name:"procfly-dir" type:"existingFile" default:"."`
+	Platform   string `name:"platform" default:"auto" env:"PROCFLY_PLATFORM" enum:"auto,fly,kubernetes,docker,host" help:"Where procfly is running, which sets .Platform"`
+}
+
+func (cli *CheckCmd) Run() error {
+	paths := file.NewPaths(cli.ProcflyDir)
+
+	problems := checkProcflyFile(paths, cli.Platform)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in %s", len(problems), paths.ProcflyFile)
+	}
+	fmt.Printf("%s is valid\n", paths.ProcflyFile)
+	return nil
+}
+
+type problem struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (p problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Err)
+}
+
+type checker struct {
+	paths    file.Paths
+	file     string
+	root     *yaml.Node
+	problems []problem
+}
+
+func (c *checker) report(err error, path ...string) {
+	var cerr configError
+	if len(path) == 0 && errors.As(err, &cerr) {
+		path = cerr.Path
+	} else if len(path) > 0 {
+		err = configError{Path: path, Err: err}
+	}
+
+	c.problems = append(c.problems, problem{
+		File: c.file,
+		Line: locate(c.root, path...),
+		Err:  err,
+	})
+}
+
+// Check everything that can be checked about a procfly.yml
+// without running anything, returning all of the problems found.
+func checkProcflyFile(paths file.Paths, platformName string) []problem {
+	c := &checker{paths: paths, file: paths.ProcflyFile}
+
+	data, err := os.ReadFile(paths.ProcflyFile)
+	if err != nil {
+		c.report(err)
+		return c.problems
+	}
+
+	c.root = new(yaml.Node)
+	if err := yaml.Unmarshal(data, c.root); err != nil {
+		c.problems = append(c.problems, yamlProblem(c.file, err.Error()))
+		return c.problems
+	}
+
+	conf := new(ProcflyFile)
+	c.checkFields(c.root, reflect.TypeOf(conf), nil)
+	if err := c.root.Decode(conf); err != nil {
+		var terr *yaml.TypeError
+		if !errors.As(err, &terr) {
+			c.report(err)
+			return c.problems
+		}
+		for _, msg := range terr.Errors {
+			c.problems = append(c.problems, yamlProblem(c.file, msg))
+		}
+	}
+
+	if err := validateNames(paths, conf); err != nil {
+		if errs, ok := err.(util.Errors); ok {
+			for _, err := range errs {
+				c.report(err)
+			}
+		} else {
+			c.report(err)
+		}
+	}
+
+	var disc privnet.Discovery
+	if cached, err := openDiscovery(paths, conf); err != nil {
+		c.report(err)
+		disc = privnet.NewFlyDNS("")
+	} else {
+		disc = cached
+	}
+
+	if _, err := openElector(paths, conf); err != nil {
+		c.report(err)
+	}
+
+	platform, err := render.OpenPlatform(platformName, conf.Discovery)
+	if err != nil {
+		c.report(err)
+		return c.problems
+	}
+
+	vars, err := loadVars(paths, conf, disc, platform)
+	var cerr configError
+	if errors.As(err, &cerr) {
+		c.report(err)
+	} else if err != nil {
+		c.report(fmt.Errorf("unable to load variables: %w", err))
+	}
+	rndr := render.NewRenderer(paths, vars)
+	rndr.SetSecrets(vars.Secrets)
+	rndr.SetDiscovery(disc)
+	rndr.SetStrict(conf.Strict)
+	if err := rndr.Library(conf.templateLibrary()...); err != nil {
+		c.report(err, "template_library")
+	}
+
+	for _, name := range util.StableIter(conf.InlineTemplates) {
+		if err := rndr.RenderWith(name, conf.InlineTemplates[name].Template, conf.InlineTemplates[name].TemplateOptions, io.Discard); err != nil {
+			c.report(err, "templates", name)
+		}
+		c.checkOptions(conf, name, conf.InlineTemplates[name].TemplateOptions, "templates", name)
+	}
+
+	for _, name := range util.StableIter(conf.TemplateFiles) {
+		tf := conf.TemplateFiles[name]
+		files, err := rndr.Expand(name, tf)
+		if err != nil {
+			c.report(err, "template_files", name)
+		}
+		for _, dest := range util.StableIter(files) {
+			tmpl, err := paths.Read(files[dest])
+			if err != nil {
+				c.report(err, "template_files", name)
+			} else if err := rndr.RenderWith(files[dest], string(tmpl), tf.TemplateOptions, io.Discard); err != nil {
+				c.report(err, "template_files", name)
+			}
+		}
+		c.checkOptions(conf, name, tf.TemplateOptions, "template_files", name)
+	}
+
+	c.checkCommands(rndr, "init", conf.Init)
+	c.checkCommands(rndr, "reload", conf.Reloaders)
+	for _, name := range util.StableIter(conf.Processes) {
+		spec := conf.Processes[name]
+		c.checkCommand(rndr, spec.Command, "processes", name)
+		c.checkCondition(rndr, spec.When, "processes", name, "when")
+		for i, rs := range spec.OnOutput {
+			path := []string{"processes", name, "on_output", strconv.Itoa(i)}
+			if _, err := renderOutputRule(rndr, rs); err != nil {
+				c.report(err, path...)
+			} else if rs.Run != "" {
+				c.checkCommand(rndr, rs.Run, path...)
+			}
+		}
+	}
+
+	c.checkActions(conf, conf.OnPeersChange.Actions, "on_peers_change")
+
+	for i, sc := range conf.Logs {
+		switch sc.Type {
+		case "syslog", "json", "http":
+		default:
+			c.report(fmt.Errorf("unknown log sink %q", sc.Type), "logs", strconv.Itoa(i))
+		}
+	}
+
+	return c.problems
+}
+
+// Make sure the template's options & on_change actions are valid
+func (c *checker) checkOptions(conf *ProcflyFile, dest string, opts render.TemplateOptions, path ...string) {
+	if _, err := file.LookupUID(opts.Owner); err != nil {
+		c.report(err, subpath(path, "owner")...)
+	}
+	if _, err := file.LookupGID(opts.Group); err != nil {
+		c.report(err, subpath(path, "group")...)
+	}
+	if opts.Check != "" {
+		dest := c.paths.Resolve(dest)
+		rndr := render.NewRenderer(c.paths, render.CheckVars{Path: dest, Dest: dest})
+		c.checkCommand(rndr, opts.Check, subpath(path, "check")...)
+	}
+
+	c.checkActions(conf, opts.OnChange, subpath(path, "on_change")...)
+}
+
+// Make sure the actions are valid, and refer to commands that exist
+func (c *checker) checkActions(conf *ProcflyFile, actions []process.OnChange, path ...string) {
+	for i, action := range actions {
+		apath := subpath(path, strconv.Itoa(i))
+		if err := action.Validate(); err != nil {
+			c.report(err, apath...)
+			continue
+		}
+
+		if _, ok := conf.Reloaders[action.Reload]; action.Reload != "" && !ok {
+			c.report(fmt.Errorf("unknown reload command %q", action.Reload), apath...)
+		}
+		for _, name := range []string{action.Restart, action.Process} {
+			if _, ok := conf.Processes[name]; name != "" && !ok {
+				c.report(fmt.Errorf("unknown process %q", name), apath...)
+			}
+		}
+		if action.Run.Name != "" {
+			if _, err := exec.LookPath(action.Run.Name); err != nil {
+				c.report(err, apath...)
+			}
+		}
+	}
+}
+
+func (c *checker) checkCommands(rndr *render.Renderer, section string, specs map[string]CommandSpec) {
+	for _, name := range util.StableIter(specs) {
+		c.checkCommand(rndr, specs[name].Command, section, name)
+		c.checkCondition(rndr, specs[name].When, section, name, "when")
+	}
+}
+
+func (c *checker) checkCondition(rndr *render.Renderer, tmpl string, path ...string) {
+	if _, err := rndr.Condition(tmpl); err != nil {
+		c.report(err, path...)
+	}
+}
+
+// Make sure the command renders, and that its binary can be found
+func (c *checker) checkCommand(rndr *render.Renderer, tmpl string, path ...string) {
+	cmd, err := rndr.Command(tmpl)
+	if err != nil {
+		c.report(err, path...)
+		return
+	}
+
+	if _, err := exec.LookPath(cmd.Name); err != nil {
+		c.report(err, path...)
+	}
+}
+
+// Report every mapping key that doesn't correspond to a field
+// of the type it will be decoded into.
+func (c *checker) checkFields(node *yaml.Node, t reflect.Type, path []string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, n := range node.Content {
+			c.checkFields(n, t, path)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if ft, ok := fields[key]; ok {
+				c.checkFields(value, ft, subpath(path, key))
+			} else {
+				c.problems = append(c.problems, problem{
+					File: c.file,
+					Line: node.Content[i].Line,
+					Err:  configError{Path: subpath(path, key), Err: errors.New("unknown field")},
+				})
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			c.checkFields(node.Content[i+1], t.Elem(), subpath(path, node.Content[i].Value))
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, n := range node.Content {
+			c.checkFields(n, t.Elem(), subpath(path, strconv.Itoa(i)))
+		}
+	}
+}
+
+func subpath(path []string, key string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), key)
+}
+
+// Map the yaml keys of a struct's fields, including inlined structs, to their types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		} else if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		} else if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// Find the line of the key (or sequence item) at the given path
+func locate(node *yaml.Node, path ...string) int {
+	if node == nil {
+		return 0
+	}
+
+	line := node.Line
+	for _, key := range path {
+		if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+			node = node.Content[0]
+		}
+
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line, next = node.Content[i].Line, node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(key); err == nil && idx < len(node.Content) {
+				next = node.Content[idx]
+				line = next.Line
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+func yamlProblem(file, msg string) problem {
+	p := problem{File: file, Err: errors.New(msg)}
+	if m := yamlLine.FindStringSubmatch(msg); m != nil {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Err = errors.New(m[2])
+	}
+	return p
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestCheckFields(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{"known fields", "strict: true\ndiscovery:\n  app: nats\nprocesses:\n  nats: nats-server\n", nil},
+		{
+			"unknown nested key",
+			"discovery:\n  app: nats\n  servce: nats\n",
+			[]string{"procfly.yml:3: discovery.servce: unknown field"},
+		},
+		{
+			"unknown key under a map of structs",
+			"processes:\n  nats:\n    command: nats-server\n    leader: true\n",
+			[]string{"procfly.yml:4: processes.nats.leader: unknown field"},
+		},
+		{
+			"unknown key in a sequence",
+			"logs:\n  - type: json\n    adress: tcp://logs:5000\n",
+			[]string{"procfly.yml:3: logs.0.adress: unknown field"},
+		},
+		{
+			// Problems are reported in the order they appear in the file
+			"line ordering",
+			"templaets: {}\nprocesses:\n  a:\n    comand: a\n  b:\n    wen: 'true'\nstrict: true\nleeder: {}\n",
+			[]string{
+				"procfly.yml:1: templaets: unknown field",
+				"procfly.yml:4: processes.a.comand: unknown field",
+				"procfly.yml:6: processes.b.wen: unknown field",
+				"procfly.yml:8: leeder: unknown field",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &checker{file: "procfly.yml", root: new(yaml.Node)}
+			if err := yaml.Unmarshal([]byte(tt.yaml), c.root); err != nil {
+				t.Fatal(err)
+			}
+			c.checkFields(c.root, reflect.TypeOf(new(ProcflyFile)), nil)
+
+			var got []string
+			for _, p := range c.problems {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLocate(t *testing.T) {
+	root := new(yaml.Node)
+	src := strings.Join([]string{
+		"strict: true",
+		"processes:",
+		"  nats:",
+		"    command: nats-server",
+		"    on_output:",
+		"      - match: fatal",
+		"      - match: slow",
+		"        action: unhealthy",
+	}, "\n")
+	if err := yaml.Unmarshal([]byte(src), root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path []string
+		want int
+	}{
+		{nil, 1},
+		{[]string{"strict"}, 1},
+		{[]string{"processes", "nats"}, 3},
+		{[]string{"processes", "nats", "command"}, 4},
+		{[]string{"processes", "nats", "on_output", "1"}, 7},
+		{[]string{"processes", "nats", "on_output", "1", "action"}, 8},
+		// Paths that don't exist are located at their closest parent
+		{[]string{"processes", "nats", "when"}, 3},
+		{[]string{"processes", "nats", "on_output", "5"}, 5},
+		{[]string{"templates", "nats.conf"}, 1},
+	} {
+		if got := locate(root, tt.path...); got != tt.want {
+			t.Errorf("%v: expected line %d, got %d", tt.path, tt.want, got)
+		}
+	}
+
+	if got := locate(nil, "strict"); got != 0 {
+		t.Errorf("expected line 0 without a document, got %d", got)
+	}
+}
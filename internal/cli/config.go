@@ -0,0 +1,371 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/process"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+type ProcflyFile struct {
+	InlineTemplates map[string]render.InlineTemplate `yaml:"templates"`
+	TemplateFiles   map[string]render.TemplateFile   `yaml:"template_files"`
+	TemplateLibrary []string                         `yaml:"template_library"`
+	Init            map[string]CommandSpec           `yaml:"init"`
+	Processes       map[string]ProcessSpec           `yaml:"processes"`
+	Reloaders       map[string]CommandSpec           `yaml:"reload"`
+	Logs            []process.SinkConfig             `yaml:"logs"`
+	Secrets         render.SecretSources             `yaml:"secrets"`
+	Discovery       privnet.DiscoveryConfig          `yaml:"discovery"`
+	Platform        PlatformSpec                     `yaml:"platform"`
+	OnPeersChange   PeersChangeSpec                  `yaml:"on_peers_change"`
+	Leader          privnet.LeaderConfig             `yaml:"leader"`
+	// Make templates & commands fail on missing map keys,
+	// such as unset environment variables
+	Strict bool `yaml:"strict"`
+}
+
+// An init or reload command, which may be configured with just its
+// command, or with a mapping that includes its command.
+type CommandSpec struct {
+	Command string `yaml:"command"`
+	// A template that renders to true or false, deciding whether the
+	// command is registered. It's re-evaluated on every refresh.
+	When string `yaml:"when"`
+}
+
+func (cs *CommandSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&cs.Command)
+	}
+	type plain CommandSpec
+	return node.Decode((*plain)(cs))
+}
+
+// A process may be configured with just its command,
+// or with a mapping that includes its command.
+type ProcessSpec struct {
+	Command  string           `yaml:"command"`
+	OnOutput []OutputRuleSpec `yaml:"on_output"`
+	// A template that renders to true or false, deciding whether the
+	// process runs. It's re-evaluated on every refresh, so the process
+	// starts & stops as its condition changes.
+	When string `yaml:"when"`
+	// Only run the process while this instance is the leader
+	LeaderOnly bool `yaml:"leader_only"`
+}
+
+func (ps *ProcessSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&ps.Command)
+	}
+	type plain ProcessSpec
+	return node.Decode((*plain)(ps))
+}
+
+// Where procfly runs, which sets .Platform. The platform itself is
+// detected, or set with --platform.
+type PlatformSpec struct {
+	// On Kubernetes, the headless service, and on Docker, the compose
+	// service, whose addresses are the app's instances. It's separate
+	// from discovery's app, which is looked up in Fly's DNS by default.
+	// Defaults to discovery's app.
+	Service string `yaml:"service"`
+}
+
+// The app whose instances are the platform's peers
+func (ps PlatformSpec) app(disc privnet.DiscoveryConfig) string {
+	if ps.Service != "" {
+		return ps.Service
+	}
+	return disc.AppName()
+}
+
+// The default time that peers must be unchanged for,
+// before the on_peers_change actions are taken
+const defaultPeersDebounce = 10 * time.Second
+
+// Actions taken once the app's peers have changed, and then stayed the
+// same for the debounce period, so that a rolling deploy causes one reload
+// rather than one per machine. Commands that are run get the change as
+// PROCFLY_PEERS_ADDED, PROCFLY_PEERS_REMOVED & PROCFLY_PEERS, which are
+// space separated IPs, and as JSON on stdin. May be configured with just
+// the list of actions.
+type PeersChangeSpec struct {
+	Debounce time.Duration      `yaml:"debounce"`
+	Actions  []process.OnChange `yaml:"actions"`
+}
+
+func (pc *PeersChangeSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&pc.Actions)
+	}
+	type plain PeersChangeSpec
+	return node.Decode((*plain)(pc))
+}
+
+func (pc PeersChangeSpec) debounce() time.Duration {
+	if pc.Debounce <= 0 {
+		return defaultPeersDebounce
+	}
+	return pc.Debounce
+}
+
+type OutputRuleSpec struct {
+	// A regular expression, matched against each line of output
+	Match string `yaml:"match"`
+	// One of restart, run or unhealthy. Defaults to run
+	// if a command is given, otherwise restart.
+	Action string `yaml:"action"`
+	// A command template, for the run action
+	Run string `yaml:"run"`
+}
+
+func loadProcflyFile(file string) (*ProcflyFile, error) {
+	pfile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer pfile.Close()
+
+	conf := new(ProcflyFile)
+	err = yaml.NewDecoder(pfile).Decode(conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, err
+}
+
+// The options for the template that renders the given file,
+// which may have been rendered from a directory or pattern.
+func (conf *ProcflyFile) templateOptions(file string) render.TemplateOptions {
+	if tmpl, ok := conf.InlineTemplates[file]; ok {
+		return tmpl.TemplateOptions
+	}
+	if tf, ok := conf.TemplateFiles[file]; ok {
+		return tf.TemplateOptions
+	}
+	for _, dest := range util.StableIter(conf.TemplateFiles) {
+		if strings.HasPrefix(file, filepath.Join(dest, "")+string(filepath.Separator)) {
+			return conf.TemplateFiles[dest].TemplateOptions
+		}
+	}
+	return render.TemplateOptions{}
+}
+
+// Globs matching the shared templates, which default to the partials directory
+func (conf *ProcflyFile) templateLibrary() []string {
+	if len(conf.TemplateLibrary) == 0 {
+		return []string{render.DefaultLibrary}
+	}
+	return conf.TemplateLibrary
+}
+
+// Load the variables for rendering, including the secrets
+func loadVars(paths file.Paths, conf *ProcflyFile, disc privnet.Discovery, platform render.Platform) (render.Vars, error) {
+	vars, err := render.LoadVars(paths, disc, conf.Discovery.AppName())
+	if err != nil {
+		return vars, err
+	}
+
+	if vars.Platform, err = platform.Load(context.Background(), conf.Platform.app(conf.Discovery), vars.Fly); err != nil {
+		return vars, fmt.Errorf("unable to load the platform's variables: %w", err)
+	}
+
+	if vars.Secrets, err = render.LoadSecrets(paths, conf.Secrets); err != nil {
+		return vars, configError{Path: []string{"secrets"}, Err: err}
+	}
+	return vars, nil
+}
+
+func openDiscovery(paths file.Paths, conf *ProcflyFile) (*privnet.CachedDiscovery, error) {
+	disc, err := conf.Discovery.Open(paths.RootDir)
+	if err != nil {
+		return nil, configError{Path: []string{"discovery"}, Err: err}
+	}
+	return privnet.NewCachedDiscovery(disc, conf.Discovery.CacheTTL, conf.Discovery.MaxStale), nil
+}
+
+// Whether each init, process & reload command should be registered,
+// keyed by its section & name, such as processes.nats
+func (conf *ProcflyFile) enabled(rndr *render.Renderer, leader bool) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	var errs util.Errors
+	check := func(section, name, when string) {
+		ok, err := rndr.Condition(when)
+		if err != nil {
+			errs = append(errs, configError{Path: []string{section, name, "when"}, Err: err})
+		}
+		enabled[section+"."+name] = ok
+	}
+
+	for _, name := range util.StableIter(conf.Init) {
+		check("init", name, conf.Init[name].When)
+	}
+	for _, name := range util.StableIter(conf.Processes) {
+		if spec := conf.Processes[name]; spec.LeaderOnly && !leader {
+			enabled["processes."+name] = false
+		} else {
+			check("processes", name, spec.When)
+		}
+	}
+	for _, name := range util.StableIter(conf.Reloaders) {
+		check("reload", name, conf.Reloaders[name].When)
+	}
+	return enabled, errs.Err()
+}
+
+func openElector(paths file.Paths, conf *ProcflyFile) (privnet.Elector, error) {
+	elector, err := conf.Leader.Open(paths.RootDir)
+	if err != nil {
+		return nil, configError{Path: []string{"leader"}, Err: err}
+	}
+	return elector, nil
+}
+
+// Whether this instance leads the app, out of the peers in vars. Peers
+// that are only known by their address, as with dns discovery without a
+// service, are elected by their address, and so is this instance when
+// it's one of them.
+func elect(elector privnet.Elector, vars render.Vars) (bool, error) {
+	self := vars.Fly.AllocID
+	ids := make([]string, 0, len(vars.Fly.Peers))
+	for _, peer := range vars.Fly.Peers {
+		if peer.AllocID != "" {
+			ids = append(ids, peer.AllocID)
+			continue
+		}
+		if peer.IP == vars.Fly.IP {
+			self = peer.IP
+		}
+		ids = append(ids, peer.IP)
+	}
+	return elector.Elect(self, ids)
+}
+
+func fileHash(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return util.Hash(data)
+}
+
+func renderProcesses(rndr *render.Renderer, specs map[string]ProcessSpec) (map[string]process.Process, error) {
+	procs := make(map[string]process.Process, len(specs))
+	for name, spec := range specs {
+		cmd, err := rndr.Command(spec.Command)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		proc := process.Process{Command: cmd}
+		for _, rs := range spec.OnOutput {
+			rule, err := renderOutputRule(rndr, rs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			proc.OnOutput = append(proc.OnOutput, rule)
+		}
+		procs[name] = proc
+	}
+	return procs, nil
+}
+
+func renderOutputRule(rndr *render.Renderer, spec OutputRuleSpec) (rule process.OutputRule, err error) {
+	if rule.Match, err = regexp.Compile(spec.Match); err != nil {
+		return
+	}
+
+	rule.Action = spec.Action
+	if rule.Action == "" && spec.Run != "" {
+		rule.Action = process.ActionRun
+	} else if rule.Action == "" {
+		rule.Action = process.ActionRestart
+	}
+
+	if spec.Run != "" {
+		if rule.Run, err = rndr.Command(spec.Run); err != nil {
+			return
+		}
+	}
+	return rule, rule.Validate()
+}
+
+// A problem with the value at the given path in procfly.yml
+type configError struct {
+	Path []string
+	Err  error
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("%s: %s", strings.Join(e.Path, "."), e.Err)
+}
+
+func (e configError) Unwrap() error {
+	return e.Err
+}
+
+// Make sure that no two templates write to the same file, and that no
+// two commands are logged with the same name.
+func validateNames(paths file.Paths, conf *ProcflyFile) error {
+	var errs util.Errors
+
+	dests := make(map[string][]string)
+	for _, section := range []struct {
+		key   string
+		names []string
+	}{
+		{"template_files", util.StableIter(conf.TemplateFiles)},
+		{"templates", util.StableIter(conf.InlineTemplates)},
+	} {
+		for _, name := range section.names {
+			dest := paths.Resolve(name)
+			if prev, ok := dests[dest]; ok {
+				errs = append(errs, configError{
+					Path: []string{section.key, name},
+					Err:  fmt.Errorf("multiple templates: %s is also written by %s", name, strings.Join(prev, ".")),
+				})
+			} else {
+				dests[dest] = []string{section.key, name}
+			}
+		}
+	}
+
+	// Init & reload commands are logged with a prefix, which could
+	// collide with a process's name.
+	logged := map[string][]string{"procfly": nil}
+	for _, name := range util.StableIter(conf.Init) {
+		logged["init_"+name] = []string{"init", name}
+	}
+	for _, name := range util.StableIter(conf.Reloaders) {
+		logged["reload_"+name] = []string{"reload", name}
+	}
+	for _, name := range util.StableIter(conf.Processes) {
+		logged["action_"+name] = []string{"processes", name}
+	}
+	for _, name := range util.StableIter(conf.Processes) {
+		if prev, ok := logged[name]; ok {
+			other := "procfly itself"
+			if prev != nil {
+				other = strings.Join(prev, ".")
+			}
+			errs = append(errs, configError{
+				Path: []string{"processes", name},
+				Err:  fmt.Errorf("name collides with %s", other),
+			})
+		}
+	}
+
+	return errs.Err()
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestElectOffFly(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "")
+	t.Setenv("FLY_ALLOC_ID", "")
+
+	paths := file.NewPaths(t.TempDir())
+	conf := &ProcflyFile{Discovery: privnet.DiscoveryConfig{Type: "env", App: "nats"}}
+	platform, err := render.OpenPlatform("host", conf.Discovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		allocIDs string
+	}{
+		// Each instance is only known by its address
+		{"by address", ""},
+		{"by alloc id", "b2,a1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROCFLY_NATS_PEER_IPS", "10.0.0.2,10.0.0.1")
+			t.Setenv("PROCFLY_NATS_ALLOC_IDS", tt.allocIDs)
+
+			var leaders []string
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+				t.Setenv("PROCFLY_LOCAL_IP", ip)
+				if tt.allocIDs != "" {
+					// Each instance's own alloc ID is the one paired with its address
+					t.Setenv("FLY_ALLOC_ID", map[string]string{"10.0.0.1": "a1", "10.0.0.2": "b2"}[ip])
+				}
+
+				// Each instance has its own discovery, with its own cache
+				disc, err := openDiscovery(paths, conf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vars, err := loadVars(paths, conf, disc, platform)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if leader, err := elect(privnet.PeersElector{}, vars); err != nil {
+					t.Fatal(err)
+				} else if leader {
+					leaders = append(leaders, ip)
+				}
+			}
+
+			if len(leaders) != 1 {
+				t.Errorf("expected exactly one leader, got %v", leaders)
+			}
+		})
+	}
+}
+
+func TestPlatformService(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "")
+
+	// With the default fly discovery, the service isn't looked up in Fly's DNS
+	paths := file.NewPaths(t.TempDir())
+	conf := &ProcflyFile{Platform: PlatformSpec{Service: "nats"}}
+	disc, err := openDiscovery(paths, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform, err := render.OpenPlatform("host", conf.Discovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := loadVars(paths, conf, disc, platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Platform.App != "nats" || vars.Fly.AppName != "local" {
+		t.Errorf("expected the platform's app to be nats, and fly's local, got %q & %q", vars.Platform.App, vars.Fly.AppName)
+	}
+
+	// Without a service, the platform's app is discovery's
+	conf = &ProcflyFile{Discovery: privnet.DiscoveryConfig{Type: "env", App: "nats"}}
+	if app := conf.Platform.app(conf.Discovery); app != "nats" {
+		t.Errorf("expected discovery's app, got %q", app)
+	}
+}
@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/maidata/procfly/internal/privnet"
+)
+
+type DevDNSCmd struct {
+	PeersFile string `arg:"" name:"peers-file" type:"existingfile" help:"A static discovery file of apps & their peers"`
+	Listen    string `name:"listen" short:"l" default:"[::1]:5353" help:"The address to answer DNS queries on"`
+}
+
+// Serve a fake Fly .internal DNS, so that clustered configs can be run
+// locally, with FLY_NAMESERVER or discovery.nameserver set to its address.
+func (cli *DevDNSCmd) Run() error {
+	srv, err := privnet.ListenDevDNS(cli.Listen, cli.PeersFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	fmt.Printf("serving %s on %s, use FLY_NAMESERVER=%s\n", cli.PeersFile, srv.Addr(), srv.Addr())
+	return srv.Serve()
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/maidata/procfly/internal/process"
+	"github.com/maidata/procfly/internal/util"
+)
+
+// Serve the health of the processes on addr until ctx is done, for the
+// platform's health checks to poll.
+func serveHealth(ctx context.Context, svisor process.Supervisor, addr string) (func() error, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: healthHandler(svisor), ReadHeaderTimeout: 5 * time.Second}
+
+	return func() error {
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, nil
+}
+
+// Responds 200 when every process is healthy, and otherwise 503, with
+// each unhealthy process & why it was marked unhealthy
+func healthHandler(svisor process.Supervisor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		unhealthy := svisor.Unhealthy()
+		if len(unhealthy) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, name := range util.StableIter(unhealthy) {
+			fmt.Fprintf(w, "%s: %s\n", name, unhealthy[name])
+		}
+	})
+}
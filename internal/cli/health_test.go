@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/maidata/procfly/internal/process"
+)
+
+// A supervisor that records what it's asked to do, without running
+// anything. Methods that aren't overridden panic.
+type fakeSupervisor struct {
+	process.Supervisor
+
+	mu        sync.Mutex
+	unhealthy map[string]string
+	triggered []process.OnChange
+	logs      []string
+	// Registered commands, keyed by their section & name, such as processes.nats
+	registered map[string]bool
+}
+
+func (f *fakeSupervisor) register(key string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.registered == nil {
+		f.registered = make(map[string]bool)
+	}
+	if ok {
+		f.registered[key] = true
+	} else {
+		delete(f.registered, key)
+	}
+}
+
+func (f *fakeSupervisor) RegisterInit(name string, _ process.Command) {
+	f.register("init."+name, true)
+}
+
+func (f *fakeSupervisor) RegisterProcess(name string, _ process.Process) {
+	f.register("processes."+name, true)
+}
+
+func (f *fakeSupervisor) RegisterReload(name string, _ process.Command) {
+	f.register("reload."+name, true)
+}
+
+func (f *fakeSupervisor) RemoveInit(name string) {
+	f.register("init."+name, false)
+}
+
+func (f *fakeSupervisor) RemoveProcess(name string) {
+	f.register("processes."+name, false)
+}
+
+func (f *fakeSupervisor) RemoveReload(name string) {
+	f.register("reload."+name, false)
+}
+
+func (f *fakeSupervisor) Trigger(action process.OnChange) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.triggered = append(f.triggered, action)
+	return nil
+}
+
+func (f *fakeSupervisor) Log(name, msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs = append(f.logs, msg)
+}
+
+func (f *fakeSupervisor) Logf(name, format string, args ...any) {
+	f.Log(name, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeSupervisor) Unhealthy() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.unhealthy
+}
+
+func TestHealthHandler(t *testing.T) {
+	svisor := new(fakeSupervisor)
+	handler := healthHandler(svisor)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("expected a healthy response, got %d %q", rec.Code, rec.Body)
+	}
+
+	svisor.unhealthy = map[string]string{"nats": `output matched "deadlock"`, "api": "output matched \"oom\""}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	want := "api: output matched \"oom\"\nnats: output matched \"deadlock\"\n"
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != want {
+		t.Errorf("expected an unhealthy response, got %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+)
+
+type RenderCmd struct {
+	ProcflyDir  string   `arg:"" name:"procfly-dir" type:"existingFile" default:"."`
+	Set         []string `name:"set" sep:"none" help:"Override a variable, e.g. --set Fly.Region=ams. Values that aren't strings are JSON, e.g. --set Fly.VMMemoryMB=512"`
+	Vars        string   `name:"vars" type:"existingfile" help:"A JSON file of variables, merged over the loaded ones"`
+	Out         string   `name:"out" short:"o" help:"Write rendered templates into this directory, instead of stdout"`
+	Temp        bool     `name:"temp" help:"Write rendered templates into a new temporary directory"`
+	Diff        bool     `name:"diff" short:"d" help:"Show a diff against the files currently on disk"`
+	ShowSecrets bool     `name:"show-secrets" help:"Don't redact secrets from the output"`
+	Platform    string   `name:"platform" default:"auto" env:"PROCFLY_PLATFORM" enum:"auto,fly,kubernetes,docker,host" help:"Where procfly is running, which sets .Platform"`
+}
+
+func (cli *RenderCmd) Run() error {
+	paths := file.NewPaths(cli.ProcflyDir)
+
+	conf, err := loadProcflyFile(paths.ProcflyFile)
+	if err != nil {
+		return err
+	}
+
+	disc, err := openDiscovery(paths, conf)
+	if err != nil {
+		return err
+	}
+
+	platform, err := render.OpenPlatform(cli.Platform, conf.Discovery)
+	if err != nil {
+		return err
+	}
+
+	vars, err := loadVars(paths, conf, disc, platform)
+	if err != nil {
+		return err
+	}
+
+	if err := cli.overrideVars(&vars); err != nil {
+		return err
+	}
+	rndr := render.NewRenderer(paths, vars)
+	rndr.SetSecrets(vars.Secrets)
+	rndr.SetDiscovery(disc)
+	redact := rndr.Redact
+	if cli.ShowSecrets {
+		redact = func(s string) string { return s }
+	}
+	rndr.SetStrict(conf.Strict)
+	if err := rndr.Library(conf.templateLibrary()...); err != nil {
+		return configError{Path: []string{"template_library"}, Err: err}
+	}
+
+	if cli.Temp {
+		if cli.Out, err = os.MkdirTemp("", "procfly-render-"); err != nil {
+			return err
+		}
+	}
+
+	rendered, err := renderAll(rndr, paths, conf)
+	if err != nil {
+		return err
+	}
+
+	for _, dest := range util.StableIter(rendered) {
+		if err := cli.output(paths, dest, []byte(redact(string(rendered[dest]))), redact); err != nil {
+			return err
+		}
+	}
+
+	// Leadership is only decided by procfly run, so
+	// leader only processes are shown as they are.
+	enabled, err := conf.enabled(rndr, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("# commands")
+	for _, section := range []struct {
+		key   string
+		tmpls map[string]string
+	}{
+		{"init", commandTemplates(conf.Init)},
+		{"processes", processCommands(conf.Processes)},
+		{"reload", commandTemplates(conf.Reloaders)},
+	} {
+		for _, name := range util.StableIter(section.tmpls) {
+			tmpl := section.tmpls[name]
+			cmd, err := rndr.Command(tmpl)
+			switch {
+			case !enabled[section.key+"."+name] && err != nil:
+				// A disabled command isn't rendered by procfly run,
+				// so it's shown as it is if it can't be rendered.
+				fmt.Printf("%s.%s: (when false) %s\n", section.key, name, redact(tmpl))
+			case err != nil:
+				return fmt.Errorf("%s.%s: %w", section.key, name, err)
+			case !enabled[section.key+"."+name]:
+				fmt.Printf("%s.%s: (when false) %s\n", section.key, name, redact(cmd.String()))
+			default:
+				fmt.Printf("%s.%s: %s\n", section.key, name, redact(cmd.String()))
+			}
+		}
+	}
+	return nil
+}
+
+// Output a rendered file, whose content has already been redacted
+func (cli *RenderCmd) output(paths file.Paths, dest string, content []byte, redact func(string) string) error {
+	if cli.Diff {
+		current, err := os.ReadFile(paths.Resolve(dest))
+		aName := "a/" + dest
+		if errors.Is(err, fs.ErrNotExist) {
+			aName = "/dev/null"
+		} else if err != nil {
+			return err
+		}
+
+		if diff := util.UnifiedDiff(aName, "b/"+dest, redact(string(current)), string(content)); diff != "" {
+			fmt.Print(diff)
+		}
+	}
+
+	if cli.Out != "" {
+		path := filepath.Join(cli.Out, dest)
+		if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("# rendered %s to %s\n", dest, path)
+	} else if !cli.Diff {
+		fmt.Printf("==> %s <==\n", dest)
+		fmt.Print(string(content))
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			fmt.Println()
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// Apply the --vars file & --set overrides to the loaded vars, keeping
+// their types, so that templates see the same kinds of values as they
+// do with procfly run.
+func (cli *RenderCmd) overrideVars(vars *render.Vars) error {
+	if cli.Vars != "" {
+		p, err := os.ReadFile(cli.Vars)
+		if err != nil {
+			return err
+		}
+		// Objects are merged into the loaded vars, and anything else replaces them
+		if err := json.Unmarshal(p, vars); err != nil {
+			return fmt.Errorf("%s: %w", cli.Vars, err)
+		}
+	}
+
+	for _, set := range cli.Set {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("invalid --set %q, expected Key.Path=value", set)
+		}
+		if err := setVar(reflect.ValueOf(vars).Elem(), strings.Split(key, "."), value); err != nil {
+			return fmt.Errorf("invalid --set %q: %w", set, err)
+		}
+	}
+	return nil
+}
+
+// Set the field, map key or slice item at the path. Strings are set
+// as they are, and anything else is parsed as JSON.
+func setVar(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		if v.Kind() == reflect.String {
+			v.SetString(value)
+			return nil
+		}
+		ptr := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Set(ptr.Elem())
+		return nil
+	}
+
+	key := path[0]
+	switch v.Kind() {
+	case reflect.Struct:
+		f := v.FieldByName(key)
+		if !f.IsValid() || !f.CanSet() {
+			return fmt.Errorf("unknown variable %q", key)
+		}
+		return setVar(f, path[1:], value)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		k := reflect.ValueOf(key).Convert(v.Type().Key())
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if current := v.MapIndex(k); current.IsValid() {
+			elem.Set(current)
+		}
+		if err := setVar(elem, path[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, elem)
+		return nil
+	case reflect.Slice:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= v.Len() {
+			return fmt.Errorf("no item %q, out of %d", key, v.Len())
+		}
+		return setVar(v.Index(i), path[1:], value)
+	default:
+		return fmt.Errorf("can't set %q on a %s", key, v.Type())
+	}
+}
+
+// Render every template in memory, keyed by destination
+func renderAll(rndr *render.Renderer, paths file.Paths, conf *ProcflyFile) (map[string][]byte, error) {
+	rendered := make(map[string][]byte)
+	for dest, tmpl := range conf.InlineTemplates {
+		buf := new(bytes.Buffer)
+		if err := rndr.RenderWith(dest, tmpl.Template, tmpl.TemplateOptions, buf); err != nil {
+			return nil, err
+		}
+		rendered[dest] = buf.Bytes()
+	}
+
+	for name, tf := range conf.TemplateFiles {
+		files, err := rndr.Expand(name, tf)
+		if err != nil {
+			return nil, err
+		}
+
+		for dest, src := range files {
+			tmpl, err := paths.Read(src)
+			if err != nil {
+				return nil, err
+			}
+
+			buf := new(bytes.Buffer)
+			if err := rndr.RenderWith(src, string(tmpl), tf.TemplateOptions, buf); err != nil {
+				return nil, err
+			}
+			rendered[dest] = buf.Bytes()
+		}
+	}
+	return rendered, nil
+}
+
+func commandTemplates(specs map[string]CommandSpec) map[string]string {
+	cmds := make(map[string]string, len(specs))
+	for name, spec := range specs {
+		cmds[name] = spec.Command
+	}
+	return cmds
+}
+
+func processCommands(specs map[string]ProcessSpec) map[string]string {
+	cmds := make(map[string]string, len(specs))
+	for name, spec := range specs {
+		cmds[name] = spec.Command
+	}
+	return cmds
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestOverrideVars(t *testing.T) {
+	varsFile := filepath.Join(t.TempDir(), "vars.json")
+	if err := os.WriteFile(varsFile, []byte(`{"Env": {"EXTRA": "1"}, "Fly": {"Region": "fra"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := render.Vars{
+		Env: render.EnvVars{"HOME": "/root"},
+		Fly: render.FlyVars{Region: "lhr", AppName: "nats", VMMemoryMB: 256},
+		Platform: render.PlatformVars{
+			Peers: []render.PlatformPeer{{ID: "a", Region: "lhr"}},
+		},
+	}
+	cli := &RenderCmd{Vars: varsFile, Set: []string{
+		"Fly.Region=ams",
+		"Fly.VMMemoryMB=512",
+		`Fly.AllRegions=["ams","lhr"]`,
+		"Env.PORT=4222",
+		"Procfly.IsLeader=true",
+		"Platform.Peers.0.Region=ams",
+		"Platform.Meta.namespace=default",
+	}}
+	if err := cli.overrideVars(&vars); err != nil {
+		t.Fatal(err)
+	}
+
+	want := render.Vars{
+		Env:     render.EnvVars{"HOME": "/root", "EXTRA": "1", "PORT": "4222"},
+		Fly:     render.FlyVars{Region: "ams", AppName: "nats", VMMemoryMB: 512, AllRegions: []string{"ams", "lhr"}},
+		Procfly: render.ProcflyVars{IsLeader: true},
+		Platform: render.PlatformVars{
+			Peers: []render.PlatformPeer{{ID: "a", Region: "ams"}},
+			Meta:  map[string]string{"namespace": "default"},
+		},
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("expected %+v, got %+v", want, vars)
+	}
+
+	for _, set := range []string{
+		"Fly.Region",
+		"Fly.Bogus=1",
+		"Fly.VMMemoryMB=lots",
+		"Fly.Region.Name=ams",
+		"Platform.Peers.5.Region=ams",
+	} {
+		cli := &RenderCmd{Set: []string{set}}
+		if err := cli.overrideVars(&vars); err == nil {
+			t.Errorf("%s: expected an error", set)
+		}
+	}
+}
+
+func TestRenderCmd(t *testing.T) {
+	dir := t.TempDir()
+	conf := `strict: true
+templates:
+  nats.conf:
+    template: |
+      port: {{ .Env.NATS_PORT }}
+      {{- if eq .Fly.VMMemoryMB 512 }}
+      max_mem: 256MB
+      {{- end }}
+      leader: {{ if .Procfly.IsLeader }}yes{{ else }}no{{ end }}
+processes:
+  nats: nats-server --port {{ .Env.NATS_PORT }}
+  debug:
+    command: debug --port {{ .Env.DEBUG_PORT }}
+    when: "false"
+`
+	if err := os.WriteFile(filepath.Join(dir, "procfly.yml"), []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &RenderCmd{
+		ProcflyDir: dir,
+		Platform:   "host",
+		Set:        []string{"Env.NATS_PORT=4222", "Fly.VMMemoryMB=512", "Procfly.IsLeader=false"},
+	}
+	out := captureStdout(t, cli.Run)
+
+	want := "==> nats.conf <==\nport: 4222\nmax_mem: 256MB\nleader: no\n\n# commands\nprocesses.debug: (when false) debug --port {{ .Env.DEBUG_PORT }}\nprocesses.nats: nats-server --port 4222\n"
+	if out != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		p, _ := io.ReadAll(r)
+		out <- string(p)
+	}()
+
+	err = f()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-out
+}
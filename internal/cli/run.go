@@ -2,30 +2,29 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
 	"github.com/maidata/procfly/internal/process"
 	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
 	"golang.org/x/sync/errgroup"
-	"gopkg.in/yaml.v3"
 )
 
-type ProcflyFile struct {
-	InlineTemplates map[string]string `yaml:"templates"`
-	TemplateFiles   map[string]string `yaml:"template_files"`
-	Init            map[string]string `yaml:"init"`
-	Processes       map[string]string `yaml:"processes"`
-	Reloaders       map[string]string `yaml:"reload"`
-}
-
 type RunCmd struct {
-	ProcflyDir string `arg:"" name:"procfly-dir" type:"existingFile" default:"."`
+	ProcflyDir      string        `arg:"" name:"procfly-dir" type:"existingFile" default:"."`
+	RefreshInterval time.Duration `name:"refresh-interval" default:"5s" env:"PROCFLY_REFRESH_INTERVAL" help:"How often variables are reloaded, and templates re-rendered"`
+	Platform        string        `name:"platform" default:"auto" env:"PROCFLY_PLATFORM" enum:"auto,fly,kubernetes,docker,host" help:"Where procfly is running, which sets .Platform"`
+	HealthListen    string        `name:"health-listen" env:"PROCFLY_HEALTH_LISTEN" help:"An address, such as :8080, to serve health checks on. It fails while any process is unhealthy."`
 }
 
 func (cli *RunCmd) Run() error {
@@ -36,34 +35,41 @@ func (cli *RunCmd) Run() error {
 		return err
 	}
 
-	err = validateTemplateNames(conf.TemplateFiles, conf.InlineTemplates)
+	err = validateNames(paths, conf)
 	if err != nil {
 		return err
 	}
 
-	vars, err := render.LoadVars(paths)
+	disc, err := openDiscovery(paths, conf)
 	if err != nil {
 		return err
 	}
 
-	rndr := render.NewRenderer(paths, vars)
-
-	if err := renderTemplatedFiles(rndr, conf); err != nil {
+	elector, err := openElector(paths, conf)
+	if err != nil {
 		return err
 	}
+	defer elector.Resign()
 
-	inits, err := rndr.Commands(conf.Init)
+	platform, err := render.OpenPlatform(cli.Platform, conf.Discovery)
 	if err != nil {
 		return err
 	}
 
-	cmds, err := rndr.Commands(conf.Processes)
+	vars, err := loadVars(paths, conf, disc, platform)
 	if err != nil {
 		return err
 	}
+	if vars.Procfly.IsLeader, err = elect(elector, vars); err != nil {
+		return err
+	}
 
-	reloaders, err := rndr.Commands(conf.Reloaders)
-	if err != nil {
+	rndr := render.NewRenderer(paths, vars)
+	rndr.SetSecrets(vars.Secrets)
+	rndr.SetDiscovery(disc)
+	rndr.SetStrict(conf.Strict)
+
+	if err := renderTemplatedFiles(rndr, conf); err != nil {
 		return err
 	}
 
@@ -73,67 +79,197 @@ func (cli *RunCmd) Run() error {
 	defer cancel()
 	egrp, gctx := errgroup.WithContext(ctx)
 
+	sout, err := openMuxWriter(conf.Logs)
+	if err != nil {
+		return err
+	}
+	defer sout.Close()
+
 	// Create a process supervisor, registering
 	// all process & reload commands.
-	svisor := process.NewSupervisor(gctx)
-	for name, cmd := range inits {
-		svisor.RegisterInit(name, cmd)
-	}
-	for name, cmd := range cmds {
-		svisor.RegisterProcess(name, cmd)
+	svisor := process.NewSupervisor(gctx, sout)
+	svisor.SetRedact(rndr.Redact)
+	logDiscovery(svisor, disc)
+	platform.SetLogf(func(format string, args ...any) {
+		svisor.Logf("procfly", format, args...)
+	})
+	if err := apply(svisor, rndr, new(ProcflyFile), conf, vars.Procfly.IsLeader); err != nil {
+		return err
 	}
-	for name, cmd := range reloaders {
-		svisor.RegisterReload(name, cmd)
+
+	// Processes marked as unhealthy by their on_output
+	// rules fail the health checks.
+	if cli.HealthListen != "" {
+		serve, err := serveHealth(gctx, svisor, cli.HealthListen)
+		if err != nil {
+			return err
+		}
+		egrp.Go(serve)
 	}
 
 	// Run the supervisor and environment watcher.
 	// If either exits with an error, gctx will be
 	// cancelled, and the other should stop.
 	egrp.Go(svisor.Run)
-	egrp.Go(watchEnv(gctx, svisor, paths, rndr, conf))
+	egrp.Go(watchEnv(gctx, svisor, paths, rndr, conf, disc, elector, platform, vars, cli.RefreshInterval))
 
 	// Wait for something to fail out, or for a
 	// signal to be received, telling us to exit.
 	return egrp.Wait()
 }
 
-func watchEnv(ctx context.Context, svisor process.Supervisor, paths file.Paths, renderer *render.Renderer, conf *ProcflyFile) func() error {
+func watchEnv(ctx context.Context, svisor process.Supervisor, paths file.Paths, renderer *render.Renderer, conf *ProcflyFile, disc *privnet.CachedDiscovery, elector privnet.Elector, platform render.Platform, vars render.Vars, interval time.Duration) func() error {
 	return func() error {
-		t := time.NewTicker(5 * time.Second)
+		defer func() { elector.Resign() }()
+
+		t := time.NewTicker(interval)
 		defer t.Stop()
-		phash := renderer.Hash()
+
+		// Changes to procfly.yml, or to any file that's read
+		// while rendering, also trigger a refresh.
+		watcher, err := file.NewWatcher()
+		if err != nil {
+			return err
+		}
+		defer watcher.Close()
+		watchFiles(svisor, watcher, paths, renderer)
+		var settle <-chan time.Time
+		// A SIGHUP triggers an immediate refresh, without
+		// having to wait for the next tick.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		chash, err := fileHash(paths.ProcflyFile)
+		if err != nil {
+			return err
+		}
+
+		// The peers, which run on_peers_change once they've settled
+		peers := newPeerChanges(vars.Fly.PeerIPs)
+
+		// What was registered, which changes as when
+		// conditions & leadership change
+		enabled, _ := conf.enabled(renderer, vars.Procfly.IsLeader)
 
 		for {
 			select {
 			case <-ctx.Done():
 				return nil
+			case <-hup:
+				svisor.Log("procfly", "Received SIGHUP, refreshing.")
 			case <-t.C:
-				// We should periodically reload the rendering variables,
-				// and reset the renderer so its hash will be reset. This
-				// lets us figure out whether any configurations have
-				// been changed by an update to the vars
-				if vars, err := render.LoadVars(paths); err != nil {
-					return err
-				} else {
-					renderer.Reset(vars)
+			case changed := <-watcher.Events():
+				// Files tend to change in bursts, so we wait for
+				// things to settle before refreshing.
+				if settle == nil {
+					svisor.Logf("procfly", "%s changed, refreshing.", changed)
 				}
+				settle = time.After(250 * time.Millisecond)
+				continue
+			case <-settle:
+				settle = nil
+			case <-peers.settled:
+				prev, current := peers.settle()
+				onPeersChanged(svisor, conf, prev, current)
+				continue
+			}
 
-				if err := renderTemplatedFiles(renderer, conf); err != nil {
-					return err
+			// We should periodically reload the rendering variables,
+			// and reset the renderer so its hash will be reset. This
+			// lets us figure out whether any configurations have
+			// been changed by an update to the vars. Discovery only
+			// fails once it's been failing for longer than max_stale;
+			// until then, the last peers found are used.
+			wasLeader := vars.Procfly.IsLeader
+			if next, err := loadVars(paths, conf, disc, platform); err != nil && !onlySecretsFailed(err) {
+				return err
+			} else {
+				// Secrets may be briefly unreadable while they're
+				// rotated, so we keep the last good ones until then.
+				if err != nil {
+					svisor.Logf("procfly", "Unable to load the secrets, keeping the last ones: %s", err)
+					next.Secrets = vars.Secrets
+				}
+				if next.Procfly.IsLeader, err = elect(elector, next); err != nil {
+					svisor.Logf("procfly", "Unable to elect a leader: %s", err)
+				}
+				if added, removed := peers.update(next.Fly.PeerIPs, conf.OnPeersChange.debounce()); len(added) > 0 || len(removed) > 0 {
+					svisor.Logf("procfly", "Peers changed, added: %v, removed: %v", added, removed)
 				}
+				next.Fly.DiffPeers(peers.last)
+				vars = next
+				renderer.Reset(vars)
+				renderer.SetSecrets(vars.Secrets)
+			}
+
+			// Pick up any changes to procfly.yml itself. A broken
+			// file shouldn't take everything down, so we keep running
+			// with the last good one until it's fixed.
+			next := conf
+			if hash, err := fileHash(paths.ProcflyFile); err != nil {
+				svisor.Logf("procfly", "Unable to read %s: %s", paths.ProcflyFile, err)
+			} else if hash != chash {
+				if next, err = reloadProcflyFile(renderer, paths); err != nil {
+					svisor.Logf("procfly", "Unable to apply changes to %s: %s", paths.ProcflyFile, err)
+					next = conf
+				}
+				chash = hash
+			}
 
-				// If the hash of our templated files hasn't changed,
-				// we should skip running our reloaders.
-				if hash := renderer.Hash(); hash == phash {
-					continue
+			if vars.Procfly.IsLeader != wasLeader {
+				if vars.Procfly.IsLeader {
+					svisor.Log("procfly", "This instance is now the leader.")
 				} else {
-					phash = hash
+					svisor.Log("procfly", "This instance is no longer the leader.")
 				}
+			}
+
+			// Templates are rendered before any process is started
+			// or restarted, so that processes start with their files
+			// in place. When templates fail to execute, say because a
+			// variable went missing, or their checks fail, the previous
+			// files are still in place, so we can keep going with them.
+			renderer.SetStrict(next.Strict)
+			if err := renderTemplatedFiles(renderer, next); onlyRenderingFailed(err) {
+				svisor.Logf("procfly", "Unable to render templates, keeping the previous files:\n%s", err)
+			} else if err != nil {
+				return err
+			}
+			watchFiles(svisor, watcher, paths, renderer)
 
-				svisor.Log("procfly", "Running reloaders.")
-				if err := svisor.Reload(); err == nil || errors.Is(err, process.ErrNotRunning) {
-					continue
+			if next != conf {
+				svisor.Logf("procfly", "Applying changes to %s", paths.ProcflyFile)
+				if err := apply(svisor, renderer, conf, next, vars.Procfly.IsLeader); err != nil {
+					svisor.Logf("procfly", "Unable to apply changes to %s: %s", paths.ProcflyFile, err)
+					renderer.SetStrict(conf.Strict)
+				} else {
+					if !reflect.DeepEqual(next.Discovery, conf.Discovery) {
+						disc = reopenDiscovery(svisor, paths, next, disc)
+						renderer.SetDiscovery(disc)
+					}
+					if !reflect.DeepEqual(next.Leader, conf.Leader) {
+						elector = reopenElector(svisor, paths, next, elector)
+					}
+					conf = next
+					enabled, _ = conf.enabled(renderer, vars.Procfly.IsLeader)
+				}
+			} else if next, err := conf.enabled(renderer, vars.Procfly.IsLeader); err != nil {
+				// Commands are registered or removed as their
+				// conditions, and leadership, change.
+				svisor.Logf("procfly", "Unable to evaluate conditions:\n%s", err)
+			} else if !reflect.DeepEqual(next, enabled) {
+				if err := apply(svisor, renderer, conf, conf, vars.Procfly.IsLeader); err != nil {
+					svisor.Logf("procfly", "Unable to apply the changed conditions: %s", err)
 				} else {
+					enabled = next
+				}
+			}
+
+			// If none of our templated files have changed,
+			// we should skip running our reloaders.
+			if changed := renderer.Changed(); len(changed) > 0 {
+				if err := onTemplatesChanged(svisor, conf, changed); err != nil {
 					return err
 				}
 			}
@@ -141,43 +277,221 @@ func watchEnv(ctx context.Context, svisor process.Supervisor, paths file.Paths,
 	}
 }
 
-func renderTemplatedFiles(renderer *render.Renderer, conf *ProcflyFile) error {
-	if err := renderer.InlineTemplates(conf.InlineTemplates); err != nil {
-		return err
+// Open the changed discovery, which is used from the next refresh.
+// If it can't be opened, the previous one is kept.
+func reopenDiscovery(svisor process.Supervisor, paths file.Paths, conf *ProcflyFile, prev *privnet.CachedDiscovery) *privnet.CachedDiscovery {
+	disc, err := openDiscovery(paths, conf)
+	if err != nil {
+		svisor.Logf("procfly", "Unable to change discovery, keeping the previous one: %s", err)
+		return prev
 	}
+	disc.CarryOver(prev)
+	logDiscovery(svisor, disc)
+	return disc
+}
 
-	if err := renderer.TemplateFiles(conf.TemplateFiles); err != nil {
-		return err
+// Open the changed elector, which is used from the next refresh. If it
+// can't be opened, the previous one is kept.
+func reopenElector(svisor process.Supervisor, paths file.Paths, conf *ProcflyFile, prev privnet.Elector) privnet.Elector {
+	elector, err := openElector(paths, conf)
+	if err != nil {
+		svisor.Logf("procfly", "Unable to change leader election, keeping the previous one: %s", err)
+		return prev
+	}
+	if err := prev.Resign(); err != nil {
+		svisor.Logf("procfly", "Unable to resign leadership: %s", err)
 	}
+	return elector
+}
+
+// Log the discovery failures that are covered by earlier results
+func logDiscovery(svisor process.Supervisor, disc *privnet.CachedDiscovery) {
+	disc.SetLogf(func(format string, args ...any) {
+		svisor.Logf("procfly", format, args...)
+	})
+}
+
+// Take the actions of each changed template. Templates without any
+// on_change actions cause all of the reload commands to be run.
+func onTemplatesChanged(svisor process.Supervisor, conf *ProcflyFile, changed []string) error {
+	var reloadAll bool
+	var actions []process.OnChange
+	seen := make(map[string]bool)
+	for _, file := range changed {
+		opts := conf.templateOptions(file)
+		if len(opts.OnChange) == 0 {
+			reloadAll = true
+		}
+		for _, action := range opts.OnChange {
+			if key := action.String(); !seen[key] {
+				seen[key] = true
+				actions = append(actions, action)
+			}
+		}
+	}
+
+	if reloadAll {
+		svisor.Log("procfly", "Running reloaders.")
+		if err := svisor.Reload(); err != nil && !errors.Is(err, process.ErrNotRunning) {
+			return err
+		}
+	}
+
+	for _, action := range actions {
+		if reloadAll && action.Reload != "" {
+			// Already done
+			continue
+		}
 
+		svisor.Logf("procfly", "Templates changed, running on_change: %s", action)
+		if err := svisor.Trigger(action); err != nil && !errors.Is(err, process.ErrNotRunning) {
+			svisor.Logf("procfly", "Unable to %s: %s", action, err)
+		}
+	}
 	return nil
 }
 
-func loadProcflyFile(file string) (*ProcflyFile, error) {
-	pfile, err := os.Open(file)
-	if err != nil {
-		return nil, err
+// The peers between refreshes, which are only settled once they've
+// stopped changing for the debounce period
+type peerChanges struct {
+	// The peers when they last settled, and now
+	last    []string
+	current []string
+	// Fires once the peers have settled
+	settled <-chan time.Time
+}
+
+func newPeerChanges(peers []string) *peerChanges {
+	return &peerChanges{last: peers, current: peers}
+}
+
+// Record the refreshed peers, returning the change since the previous
+// refresh. Any change restarts the debounce period.
+func (pc *peerChanges) update(peers []string, debounce time.Duration) (added, removed []string) {
+	added, removed = render.DiffPeers(pc.current, peers)
+	if len(added) > 0 || len(removed) > 0 {
+		pc.settled = time.After(debounce)
 	}
-	defer pfile.Close()
+	pc.current = peers
+	return added, removed
+}
+
+// Settle the peers, returning those from when they last settled,
+// and the current peers
+func (pc *peerChanges) settle() (prev, peers []string) {
+	prev, peers = pc.last, pc.current
+	pc.last, pc.settled = pc.current, nil
+	return prev, peers
+}
 
-	conf := new(ProcflyFile)
-	err = yaml.NewDecoder(pfile).Decode(conf)
+// Take the on_peers_change actions, if the peers are different from
+// prev. Commands that are run are given the change.
+func onPeersChanged(svisor process.Supervisor, conf *ProcflyFile, prev, peers []string) {
+	added, removed := render.DiffPeers(prev, peers)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	env := []string{
+		"PROCFLY_PEERS_ADDED=" + strings.Join(added, " "),
+		"PROCFLY_PEERS_REMOVED=" + strings.Join(removed, " "),
+		"PROCFLY_PEERS=" + strings.Join(peers, " "),
+	}
+	change, err := json.Marshal(struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+		Peers   []string `json:"peers"`
+	}{nonNil(added), nonNil(removed), nonNil(peers)})
 	if err != nil {
-		return nil, err
+		svisor.Logf("procfly", "Unable to encode the change to peers: %s", err)
+		return
 	}
-	return conf, err
+	change = append(change, '\n')
+
+	for _, action := range conf.OnPeersChange.Actions {
+		if action.Run.Name != "" {
+			action.Run.Env = env
+			action.Run.Stdin = change
+		}
+		svisor.Logf("procfly", "Peers changed, running on_peers_change: %s", action)
+		if err := svisor.Trigger(action); err != nil && !errors.Is(err, process.ErrNotRunning) {
+			svisor.Logf("procfly", "Unable to %s: %s", action, err)
+		}
+	}
+}
+
+// Encodes as an empty JSON array, rather than null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func watchFiles(svisor process.Supervisor, watcher *file.Watcher, paths file.Paths, renderer *render.Renderer) {
+	if err := watcher.Watch(append(renderer.Sources(), paths.ProcflyFile)...); err != nil {
+		svisor.Logf("procfly", "Unable to watch files for changes: %s", err)
+	}
+}
+
+// Render all of the templates, returning every failure together
+func renderTemplatedFiles(renderer *render.Renderer, conf *ProcflyFile) error {
+	var errs util.Errors
+	if err := renderer.Library(conf.templateLibrary()...); err != nil {
+		errs = append(errs, configError{Path: []string{"template_library"}, Err: err})
+	}
+
+	for _, err := range []error{
+		renderer.InlineTemplates(conf.InlineTemplates),
+		renderer.TemplateFiles(conf.TemplateFiles),
+	} {
+		if merr, ok := err.(util.Errors); ok {
+			errs = append(errs, merr...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.Err()
 }
 
-func validateTemplateNames(a, b map[string]string) error {
-	for k := range a {
-		if _, ok := b[k]; ok {
-			return fmt.Errorf("multiple templates: %s", k)
+// Whether err is only made up of templates that failed to execute, such as
+// on a missing key in strict mode, or whose checks failed. Either way, the
+// previous files are still in place.
+func onlyRenderingFailed(err error) bool {
+	failed := func(err error) bool {
+		var eerr template.ExecError
+		return errors.Is(err, render.ErrCheckFailed) || errors.As(err, &eerr)
+	}
+
+	errs, ok := err.(util.Errors)
+	if !ok {
+		return failed(err)
+	}
+	for _, err := range errs {
+		if !failed(err) {
+			return false
 		}
 	}
-	for k := range b {
-		if _, ok := a[k]; ok {
-			return fmt.Errorf("multiple templates: %s", k)
+	return true
+}
+
+// Whether loading the variables only failed to load the secrets
+func onlySecretsFailed(err error) bool {
+	var cerr configError
+	return errors.As(err, &cerr) && len(cerr.Path) == 1 && cerr.Path[0] == "secrets"
+}
+
+func openMuxWriter(confs []process.SinkConfig) (process.MuxWriter, error) {
+	sinks := make([]process.Sink, 0, len(confs))
+	for _, conf := range confs {
+		sink, err := conf.Open()
+		if err != nil {
+			for _, s := range sinks {
+				_ = s.Close()
+			}
+			return nil, err
 		}
+		sinks = append(sinks, sink)
 	}
-	return nil
+	return process.NewMuxWriter(os.Stdout, sinks...), nil
 }
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/process"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+)
+
+func TestOnlyRenderingFailed(t *testing.T) {
+	checkFailed := fmt.Errorf("nats.conf: %w", render.ErrCheckFailed)
+
+	// A key that's missing in strict mode, such as an unset env var
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), render.Vars{Env: render.EnvVars{}})
+	rndr.SetStrict(true)
+	missingKey := rndr.InlineTemplates(map[string]render.InlineTemplate{
+		"nats.conf": {Template: "port {{ .Env.NATS_PORT }}"},
+	})
+
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{checkFailed, true},
+		{util.Errors{checkFailed, checkFailed}, true},
+		{missingKey, true},
+		{util.Errors{checkFailed, missingKey}, true},
+		{errors.New("permission denied"), false},
+		// Anything else is fatal, even alongside failed checks
+		{util.Errors{checkFailed, errors.New("permission denied")}, false},
+	} {
+		if got := onlyRenderingFailed(tt.err); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestOnlySecretsFailed(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{configError{Path: []string{"secrets"}, Err: errors.New("permission denied")}, true},
+		{configError{Path: []string{"discovery"}, Err: errors.New("no such host")}, false},
+		{errors.New("unable to load the platform's variables"), false},
+	} {
+		if got := onlySecretsFailed(tt.err); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestPeerChanges(t *testing.T) {
+	peers := newPeerChanges([]string{"fdaa::1", "fdaa::2"})
+	if added, removed := peers.update([]string{"fdaa::1", "fdaa::2"}, time.Hour); added != nil || removed != nil || peers.settled != nil {
+		t.Fatalf("expected no change, got %v & %v", added, removed)
+	}
+
+	// A rolling deploy replaces each peer in turn, which restarts
+	// the debounce period
+	peers.update([]string{"fdaa::1", "fdaa::3"}, time.Hour)
+	first := peers.settled
+	added, removed := peers.update([]string{"fdaa::4", "fdaa::3"}, 10*time.Millisecond)
+	if !reflect.DeepEqual(added, []string{"fdaa::4"}) || !reflect.DeepEqual(removed, []string{"fdaa::1"}) {
+		t.Errorf("expected the change since the previous refresh, got %v & %v", added, removed)
+	}
+	if peers.settled == first {
+		t.Error("expected the debounce period to restart")
+	}
+
+	select {
+	case <-peers.settled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the peers to settle")
+	}
+	prev, current := peers.settle()
+	if !reflect.DeepEqual(prev, []string{"fdaa::1", "fdaa::2"}) || !reflect.DeepEqual(current, []string{"fdaa::4", "fdaa::3"}) {
+		t.Errorf("expected the whole deploy as one change, got %v to %v", prev, current)
+	}
+	if peers.settled != nil || !reflect.DeepEqual(peers.last, current) {
+		t.Errorf("expected the peers to have settled at %v, got %v", current, peers.last)
+	}
+}
+
+func TestOnPeersChanged(t *testing.T) {
+	svisor := new(fakeSupervisor)
+	conf := &ProcflyFile{OnPeersChange: PeersChangeSpec{Actions: []process.OnChange{
+		{Run: process.Command{Name: "/bin/routes"}},
+		{Reload: "nats"},
+	}}}
+
+	onPeersChanged(svisor, conf, []string{"fdaa::1"}, []string{"fdaa::1"})
+	if len(svisor.triggered) != 0 {
+		t.Fatalf("expected nothing to run without a change, got %v", svisor.triggered)
+	}
+
+	onPeersChanged(svisor, conf, []string{"fdaa::1", "fdaa::2"}, []string{"fdaa::1", "fdaa::3"})
+	if len(svisor.triggered) != 2 {
+		t.Fatalf("expected both actions to run, got %v", svisor.triggered)
+	}
+	run := svisor.triggered[0].Run
+	want := []string{"PROCFLY_PEERS_ADDED=fdaa::3", "PROCFLY_PEERS_REMOVED=fdaa::2", "PROCFLY_PEERS=fdaa::1 fdaa::3"}
+	if !reflect.DeepEqual(run.Env, want) {
+		t.Errorf("expected %v, got %v", want, run.Env)
+	}
+	if stdin := `{"added":["fdaa::3"],"removed":["fdaa::2"],"peers":["fdaa::1","fdaa::3"]}` + "\n"; string(run.Stdin) != stdin {
+		t.Errorf("expected %q on stdin, got %q", stdin, run.Stdin)
+	}
+	if svisor.triggered[1].Reload != "nats" {
+		t.Errorf("expected nats to be reloaded, got %v", svisor.triggered[1])
+	}
+}
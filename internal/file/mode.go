@@ -0,0 +1,35 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A file mode, written in octal in procfly.yml (e.g. 0640)
+type Mode os.FileMode
+
+func (m *Mode) UnmarshalYAML(node *yaml.Node) error {
+	value := strings.TrimPrefix(node.Value, "0o")
+	perm, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || perm > 0o7777 {
+		return fmt.Errorf("line %d: invalid file mode %q", node.Line, node.Value)
+	}
+	*m = Mode(perm)
+	return nil
+}
+
+func (m Mode) MarshalYAML() (any, error) {
+	return fmt.Sprintf("%04o", uint32(m)), nil
+}
+
+// Returns the mode, or def if it's unset
+func (m Mode) Or(def os.FileMode) os.FileMode {
+	if m == 0 {
+		return def
+	}
+	return os.FileMode(m)
+}
@@ -0,0 +1,40 @@
+package file
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// Look up the uid of the user, which may be given by name or
+// number. An empty name results in -1, which leaves a file's
+// owner unchanged.
+func LookupUID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	} else if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// Look up the gid of the group, which may be given by name or
+// number. An empty name results in -1, which leaves a file's
+// group unchanged.
+func LookupGID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	} else if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
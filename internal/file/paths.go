@@ -9,6 +9,9 @@ import (
 type Paths struct {
 	RootDir     string
 	ProcflyFile string
+	// The files rendered from template directories and patterns, kept
+	// across restarts so that stale ones can still be removed
+	RenderedFile string
 }
 
 func (p Paths) Open(file string, flag int, perm os.FileMode) (*os.File, error) {
@@ -21,10 +24,54 @@ func (p Paths) Open(file string, flag int, perm os.FileMode) (*os.File, error) {
 	return os.OpenFile(path, flag, perm)
 }
 
+// Write the data to a temporary file alongside the destination, and rename
+// it over the destination. The temporary file is passed to prepare before
+// it's renamed; if prepare returns an error, the destination is left as-is.
+func (p Paths) WriteAtomic(file string, data []byte, perm os.FileMode, prepare func(tmp string) error) error {
+	path := p.normalize(file)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = func() error {
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err == nil && prepare != nil {
+		err = prepare(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
 func (p Paths) Read(path string) ([]byte, error) {
 	return os.ReadFile(p.normalize(path))
 }
 
+// Resolve the file's path relative to the root directory
+func (p Paths) Resolve(file string) string {
+	return filepath.Clean(p.normalize(file))
+}
+
 func (p Paths) normalize(file string) string {
 	if strings.HasPrefix(file, "/") {
 		return file
@@ -34,7 +81,8 @@ func (p Paths) normalize(file string) string {
 
 func NewPaths(root string) Paths {
 	return Paths{
-		RootDir:     root,
-		ProcflyFile: filepath.Join(root, "procfly.yml"),
+		RootDir:      root,
+		ProcflyFile:  filepath.Join(root, "procfly.yml"),
+		RenderedFile: filepath.Join(root, ".procfly-rendered.json"),
 	}
 }
@@ -0,0 +1,143 @@
+//go:build linux
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_ATTRIB
+
+// A Watcher reports changes to a set of files, using inotify. The
+// directories containing the files are watched, rather than the files
+// themselves, so that files replaced by a rename are still picked up.
+// Watched directories report changes to any of the files in them, such
+// as new files.
+type Watcher struct {
+	ifd    int
+	fd     *os.File
+	events chan string
+
+	lck     sync.Mutex
+	files   map[string]bool
+	watched map[string]bool
+	dirs    map[string]int
+	wds     map[int]string
+}
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		// A non-blocking file is handled by the runtime's poller,
+		// so closing it will interrupt a pending read.
+		ifd:    fd,
+		fd:     os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan string, 16),
+		files:  make(map[string]bool),
+		dirs:   make(map[string]int),
+		wds:    make(map[int]string),
+	}
+	go w.read()
+	return w, nil
+}
+
+// Replace the set of watched files & directories
+func (w *Watcher) Watch(files ...string) error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	w.files = make(map[string]bool, len(files))
+	w.watched = make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			w.watched[abs] = true
+			dirs[abs] = true
+			continue
+		}
+		w.files[abs] = true
+		dirs[filepath.Dir(abs)] = true
+	}
+
+	for dir, wd := range w.dirs {
+		if !dirs[dir] {
+			_, _ = unix.InotifyRmWatch(w.ifd, uint32(wd))
+			delete(w.dirs, dir)
+			delete(w.wds, wd)
+		}
+	}
+
+	for dir := range dirs {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(w.ifd, dir, watchMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[dir] = wd
+		w.wds[wd] = dir
+	}
+	return nil
+}
+
+// The paths of changed files. Events are dropped if they aren't
+// being received, so a receiver should treat each one as "something
+// has changed", rather than an exhaustive list.
+func (w *Watcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *Watcher) Close() error {
+	return w.fd.Close()
+}
+
+// Read events until the watcher is closed, or inotify fails. The events
+// channel isn't closed, so receivers are left waiting on it, rather than
+// woken over & over again, and only periodic refreshes are left.
+func (w *Watcher) read() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.fd.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			w.lck.Lock()
+			dir, ok := w.wds[int(ev.Wd)]
+			path := filepath.Join(dir, name)
+			// Kubernetes updates mounted config maps & secrets by
+			// swapping a ..data symlink, so the files themselves
+			// never see an event.
+			changed := ok && (w.files[path] || w.watched[dir] || strings.HasPrefix(name, ".."))
+			w.lck.Unlock()
+
+			if changed {
+				select {
+				case w.events <- path:
+				default:
+				}
+			}
+		}
+	}
+}
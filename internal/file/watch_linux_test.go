@@ -0,0 +1,79 @@
+//go:build linux
+
+package file_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/file"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "nats.conf")
+	tmpls := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(tmpls, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := file.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Watch(conf, tmpls); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write is a few events, such as a create & a close
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-w.Events():
+			if got != want {
+				t.Errorf("expected %s to change, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected %s to change", want)
+		}
+		for {
+			select {
+			case <-w.Events():
+			case <-time.After(50 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	// A watched file, and a new file in a watched directory
+	if err := os.WriteFile(conf, []byte("port: 4222"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(conf)
+	if err := os.WriteFile(filepath.Join(tmpls, "routes.conf"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(filepath.Join(tmpls, "routes.conf"))
+
+	// Other files are ignored
+	if err := os.WriteFile(filepath.Join(dir, "other.conf"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-w.Events():
+		t.Errorf("expected no change, got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing the watcher doesn't close its events, which
+	// would wake anything waiting on them over & over again
+	w.Close()
+	select {
+	case got, ok := <-w.Events():
+		t.Errorf("expected no events after closing, got %q (%v)", got, ok)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package file
+
+// Without inotify, files are never reported as changed,
+// and are only picked up by periodic refreshes.
+type Watcher struct {
+	events chan string
+}
+
+func NewWatcher() (*Watcher, error) {
+	return &Watcher{events: make(chan string)}, nil
+}
+
+func (w *Watcher) Watch(files ...string) error {
+	return nil
+}
+
+func (w *Watcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package privnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCacheTTL = 15 * time.Second
+	DefaultMaxStale = 5 * time.Minute
+)
+
+// A Discovery that caches another's results, so that repeated lookups
+// don't each go to DNS. When a lookup fails, the last result is used
+// instead, until it's older than the max staleness; only then is the
+// error returned. Results are copies, which callers may sort or append
+// to, and it's safe for concurrent use.
+type CachedDiscovery struct {
+	disc     Discovery
+	ttl      time.Duration
+	maxStale time.Duration
+	logf     atomic.Value
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	value   any
+	fetched time.Time
+	// Set while lookups are failing
+	failing error
+	// Carried over from another discovery, so it's only used while
+	// lookups fail
+	expired bool
+}
+
+// Cache disc's results for ttl, serving them for up to maxStale while
+// lookups fail. Zero durations use the defaults.
+func NewCachedDiscovery(disc Discovery, ttl, maxStale time.Duration) *CachedDiscovery {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if maxStale <= 0 {
+		maxStale = DefaultMaxStale
+	}
+	return &CachedDiscovery{
+		disc:     disc,
+		ttl:      ttl,
+		maxStale: maxStale,
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+// Log failed lookups that are covered by stale results, and recoveries
+func (c *CachedDiscovery) SetLogf(logf func(format string, args ...any)) {
+	c.logf.Store(logf)
+}
+
+func (c *CachedDiscovery) PeerIPs(ctx context.Context, app string) ([]net.IP, error) {
+	values, err := cached(ctx, c, "peers of "+app, func(ctx context.Context) ([]net.IP, error) {
+		return c.disc.PeerIPs(ctx, app)
+	})
+	return append([]net.IP(nil), values...), err
+}
+
+func (c *CachedDiscovery) AllocIDs(ctx context.Context, app string) ([]string, error) {
+	values, err := cached(ctx, c, "allocation IDs of "+app, func(ctx context.Context) ([]string, error) {
+		return c.disc.AllocIDs(ctx, app)
+	})
+	return append([]string(nil), values...), err
+}
+
+func (c *CachedDiscovery) Regions(ctx context.Context, app string) ([]string, error) {
+	values, err := cached(ctx, c, "regions of "+app, func(ctx context.Context) ([]string, error) {
+		return c.disc.Regions(ctx, app)
+	})
+	return append([]string(nil), values...), err
+}
+
+func (c *CachedDiscovery) Peers(ctx context.Context, app string) ([]Peer, error) {
+	values, err := cached(ctx, c, "peer instances of "+app, func(ctx context.Context) ([]Peer, error) {
+		return c.disc.Peers(ctx, app)
+	})
+	return append([]Peer(nil), values...), err
+}
+
+func (c *CachedDiscovery) RegionPeers(ctx context.Context, app, region string) ([]Peer, error) {
+	values, err := cached(ctx, c, fmt.Sprintf("peer instances of %s in %s", app, region), func(ctx context.Context) ([]Peer, error) {
+		return c.disc.RegionPeers(ctx, app, region)
+	})
+	return append([]Peer(nil), values...), err
+}
+
+func (c *CachedDiscovery) Nearest(ctx context.Context, app string, n int) ([]Peer, error) {
+	values, err := cached(ctx, c, fmt.Sprintf("%d nearest instances of %s", n, app), func(ctx context.Context) ([]Peer, error) {
+		return c.disc.Nearest(ctx, app, n)
+	})
+	return append([]Peer(nil), values...), err
+}
+
+func (c *CachedDiscovery) LocalIP(ctx context.Context) (net.IP, error) {
+	ip, err := cached(ctx, c, "local IP", c.disc.LocalIP)
+	return append(net.IP(nil), ip...), err
+}
+
+// Keep prev's results, for when discovery is changed. They're looked up
+// again, but still cover failed lookups until they're too stale.
+func (c *CachedDiscovery) CarryOver(prev *CachedDiscovery) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range prev.entries {
+		if _, ok := c.entries[key]; !ok {
+			c.entries[key] = &cacheEntry{value: entry.value, fetched: entry.fetched, expired: true}
+		}
+	}
+}
+
+func (c *CachedDiscovery) log(format string, args ...any) {
+	if logf, ok := c.logf.Load().(func(string, ...any)); ok {
+		logf(format, args...)
+	}
+}
+
+// Look up key, unless there's a fresh enough result for it. The lock
+// isn't held while looking up, so concurrent misses may each look up.
+func cached[T any](ctx context.Context, c *CachedDiscovery, key string, lookup func(context.Context) (T, error)) (T, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && entry.failing == nil && !entry.expired && time.Since(entry.fetched) < c.ttl {
+		c.mu.Unlock()
+		return entry.value.(T), nil
+	}
+	c.mu.Unlock()
+
+	value, err := lookup(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok = c.entries[key]
+	if err == nil {
+		if ok && entry.failing != nil {
+			c.log("Discovery of the %s has recovered.", key)
+		}
+		c.entries[key] = &cacheEntry{value: value, fetched: time.Now()}
+		return value, nil
+	}
+	if !ok {
+		return value, err
+	}
+
+	age := time.Since(entry.fetched)
+	if age > c.maxStale {
+		return value, fmt.Errorf("unable to discover the %s for %s: %w", key, age.Round(time.Second), err)
+	}
+	if entry.failing == nil {
+		c.log("Unable to discover the %s, using the result from %s ago: %s", key, age.Round(time.Second), err)
+	}
+	entry.failing = err
+	return entry.value.(T), nil
+}
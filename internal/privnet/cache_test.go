@@ -0,0 +1,152 @@
+package privnet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/privnet"
+)
+
+// A Discovery that counts its lookups, and can be made to fail
+type flakyDiscovery struct {
+	lookups int
+	err     error
+	regions []string
+}
+
+func (f *flakyDiscovery) PeerIPs(ctx context.Context, app string) ([]net.IP, error) {
+	return nil, f.err
+}
+
+func (f *flakyDiscovery) AllocIDs(ctx context.Context, app string) ([]string, error) {
+	return nil, f.err
+}
+
+func (f *flakyDiscovery) Regions(ctx context.Context, app string) ([]string, error) {
+	f.lookups++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.regions, nil
+}
+
+func (f *flakyDiscovery) Peers(ctx context.Context, app string) ([]privnet.Peer, error) {
+	return nil, f.err
+}
+
+func (f *flakyDiscovery) RegionPeers(ctx context.Context, app, region string) ([]privnet.Peer, error) {
+	return nil, f.err
+}
+
+func (f *flakyDiscovery) Nearest(ctx context.Context, app string, n int) ([]privnet.Peer, error) {
+	return nil, f.err
+}
+
+func (f *flakyDiscovery) LocalIP(ctx context.Context) (net.IP, error) {
+	return nil, f.err
+}
+
+func TestCachedDiscovery(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyDiscovery{regions: []string{"lhr", "ams"}}
+	disc := privnet.NewCachedDiscovery(flaky, time.Hour, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		regions, err := disc.Regions(ctx, "nats")
+		if err != nil || !reflect.DeepEqual(regions, []string{"lhr", "ams"}) {
+			t.Fatalf("expected [lhr ams], got %v (%v)", regions, err)
+		}
+		// Changes to the result don't change the cache
+		regions[0] = "fra"
+	}
+	if flaky.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", flaky.lookups)
+	}
+
+	// Each app is cached separately
+	if _, err := disc.Regions(ctx, "redis"); err != nil || flaky.lookups != 2 {
+		t.Errorf("expected a lookup for another app, got %d (%v)", flaky.lookups, err)
+	}
+
+	// Errors aren't cached
+	flaky.err = errors.New("connection refused")
+	if _, err := disc.Regions(ctx, "postgres"); !errors.Is(err, flaky.err) {
+		t.Errorf("expected the lookup's error, got %v", err)
+	}
+}
+
+func TestCachedDiscoveryStale(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyDiscovery{regions: []string{"lhr"}}
+	disc := privnet.NewCachedDiscovery(flaky, time.Nanosecond, time.Hour)
+
+	var logs []string
+	disc.SetLogf(func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	})
+
+	if _, err := disc.Regions(ctx, "nats"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures are logged once, and covered by the last result
+	flaky.err = errors.New("i/o timeout")
+	for i := 0; i < 3; i++ {
+		regions, err := disc.Regions(ctx, "nats")
+		if err != nil || !reflect.DeepEqual(regions, []string{"lhr"}) {
+			t.Fatalf("expected the stale [lhr], got %v (%v)", regions, err)
+		}
+	}
+	if flaky.lookups != 4 {
+		t.Errorf("expected failing lookups to be retried, got %d lookups", flaky.lookups)
+	}
+
+	flaky.err = nil
+	flaky.regions = []string{"ams"}
+	if regions, err := disc.Regions(ctx, "nats"); err != nil || !reflect.DeepEqual(regions, []string{"ams"}) {
+		t.Errorf("expected [ams] after recovering, got %v (%v)", regions, err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("expected a failure & a recovery to be logged, got %q", logs)
+	}
+
+	// Past the max staleness, the error is returned
+	disc = privnet.NewCachedDiscovery(flaky, time.Nanosecond, time.Nanosecond)
+	if _, err := disc.Regions(ctx, "nats"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	flaky.err = errors.New("i/o timeout")
+	if _, err := disc.Regions(ctx, "nats"); !errors.Is(err, flaky.err) {
+		t.Errorf("expected the lookup's error, got %v", err)
+	}
+}
+
+func TestCachedDiscoveryCarryOver(t *testing.T) {
+	ctx := context.Background()
+	prev := privnet.NewCachedDiscovery(&flakyDiscovery{regions: []string{"lhr"}}, time.Hour, time.Hour)
+	if _, err := prev.Regions(ctx, "nats"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carried over results are looked up again
+	flaky := &flakyDiscovery{regions: []string{"ams"}}
+	disc := privnet.NewCachedDiscovery(flaky, time.Hour, time.Hour)
+	disc.CarryOver(prev)
+	if regions, err := disc.Regions(ctx, "nats"); err != nil || !reflect.DeepEqual(regions, []string{"ams"}) {
+		t.Errorf("expected [ams] from the new discovery, got %v (%v)", regions, err)
+	}
+
+	// But they cover failures
+	flaky = &flakyDiscovery{err: errors.New("i/o timeout")}
+	disc = privnet.NewCachedDiscovery(flaky, time.Hour, time.Hour)
+	disc.CarryOver(prev)
+	if regions, err := disc.Regions(ctx, "nats"); err != nil || !reflect.DeepEqual(regions, []string{"lhr"}) {
+		t.Errorf("expected the carried over [lhr], got %v (%v)", regions, err)
+	}
+}
@@ -0,0 +1,311 @@
+package privnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DNS record types & response codes
+const (
+	typeA    = 1
+	typeTXT  = 16
+	typeAAAA = 28
+	typeOPT  = 41
+
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+)
+
+// How long answers may be cached for, in seconds
+const devDNSTTL = 5
+
+// The largest UDP response to a client that doesn't say otherwise with EDNS
+const maxUDPSize = 512
+
+// A DNS server that answers like Fly's .internal DNS, from a static
+// discovery file, so that clustered configs can be run locally and
+// tested. It answers:
+//
+//	<app>.internal                AAAA/A of every peer
+//	<region>.<app>.internal       AAAA/A of the peers in a region
+//	<alloc_id>.vm.<app>.internal  AAAA/A of a peer
+//	top<n>.nearest.of.<app>.internal
+//	                              AAAA/A of n peers, preferring local_ip's region
+//	vms.<app>.internal            TXT "<alloc_id> <region>,..."
+//	regions.<app>.internal        TXT "<region>,..."
+//	_apps.internal                TXT "<app>,..."
+//	fly-local-6pn                 AAAA/A of the file's local_ip
+//
+// Anything else is NXDOMAIN. The file is re-read for every query, so
+// peers can be added & removed while it's running. Only UDP is served, so
+// responses too big for the client are truncated, with the TC bit set.
+type DevDNS struct {
+	static *StaticDiscovery
+	conn   net.PacketConn
+}
+
+// Listen for queries on addr, such as [::1]:5353, answering from file
+func ListenDevDNS(addr, file string) (*DevDNS, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DevDNS{static: NewStaticDiscovery(file), conn: conn}, nil
+}
+
+// The address being listened on, to use as a nameserver
+func (d *DevDNS) Addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+// Answer queries until the server is closed
+func (d *DevDNS) Serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if resp := d.handle(buf[:n]); resp != nil {
+			if _, err := d.conn.WriteTo(resp, addr); err != nil && errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+		}
+	}
+}
+
+func (d *DevDNS) Close() error {
+	return d.conn.Close()
+}
+
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type record struct {
+	Type uint16
+	Data []byte
+}
+
+// Build the response to a query, or nil if it should be ignored
+func (d *DevDNS) handle(msg []byte) []byte {
+	if len(msg) < 12 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 != 0 {
+		// Not a query
+		return nil
+	}
+
+	q, end, err := parseQuestion(msg)
+	switch {
+	case err != nil:
+		return response(msg, 12, rcodeFormErr, nil)
+	case flags&0x7800 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1:
+		// Only standard queries, with one question
+		return response(msg, end, rcodeNotImp, nil)
+	}
+
+	rcode, answers := d.answer(q)
+	resp := response(msg, end, rcode, answers)
+	if len(resp) > udpSize(msg, end) {
+		resp = response(msg, end, rcode, nil)
+		binary.BigEndian.PutUint16(resp[2:], binary.BigEndian.Uint16(resp[2:])|0x0200)
+	}
+	return resp
+}
+
+// The largest response the client accepts, from the EDNS OPT record that
+// may follow the question ending at end
+func udpSize(msg []byte, end int) int {
+	arcount := binary.BigEndian.Uint16(msg[10:12])
+	if arcount == 0 || end+5 > len(msg) || msg[end] != 0 || binary.BigEndian.Uint16(msg[end+1:]) != typeOPT {
+		return maxUDPSize
+	}
+	if size := int(binary.BigEndian.Uint16(msg[end+3:])); size > maxUDPSize {
+		return size
+	}
+	return maxUDPSize
+}
+
+func (d *DevDNS) answer(q question) (int, []record) {
+	conf, err := d.static.load()
+	if err != nil {
+		return rcodeServFail, nil
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if name == "fly-local-6pn" {
+		local := conf.LocalIP
+		if local == "" {
+			local = "127.0.0.1"
+		}
+		return ipRecords(q.Type, []string{local})
+	}
+
+	rest := strings.TrimSuffix(name, ".internal")
+	if rest == name {
+		return rcodeNXDomain, nil
+	}
+	if rest == "_apps" {
+		apps := make([]string, 0, len(conf.Apps))
+		for app := range conf.Apps {
+			apps = append(apps, app)
+		}
+		sort.Strings(apps)
+		return txtRecord(q.Type, strings.Join(apps, ","))
+	}
+
+	labels := strings.Split(rest, ".")
+	app, ok := conf.Apps[labels[len(labels)-1]]
+	if !ok {
+		return rcodeNXDomain, nil
+	}
+
+	var ips []string
+	switch {
+	case len(labels) == 1:
+		for _, peer := range app.Peers {
+			ips = append(ips, peer.IP)
+		}
+	case len(labels) == 2 && labels[0] == "vms":
+		vms := make([]string, len(app.Peers))
+		for i, peer := range app.Peers {
+			vms[i] = peer.AllocID + " " + peer.Region
+		}
+		return txtRecord(q.Type, strings.Join(vms, ","))
+	case len(labels) == 2 && labels[0] == "regions":
+		return txtRecord(q.Type, strings.Join(app.regions(), ","))
+	case len(labels) == 2:
+		for _, peer := range app.Peers {
+			if peer.Region == labels[0] {
+				ips = append(ips, peer.IP)
+			}
+		}
+	case len(labels) == 4 && labels[1] == "nearest" && labels[2] == "of" && strings.HasPrefix(labels[0], "top"):
+		n, err := strconv.Atoi(strings.TrimPrefix(labels[0], "top"))
+		if err != nil || n < 1 {
+			return rcodeNXDomain, nil
+		}
+		peers := make([]Peer, len(app.Peers))
+		for i, peer := range app.Peers {
+			peers[i] = Peer{Region: peer.Region, IP: net.ParseIP(peer.IP)}
+		}
+		for _, peer := range nearest(peers, net.ParseIP(conf.LocalIP), n) {
+			ips = append(ips, peer.IP.String())
+		}
+	case len(labels) == 3 && labels[1] == "vm":
+		for _, peer := range app.Peers {
+			if labels[0] != "" && strings.HasPrefix(peer.AllocID, labels[0]) {
+				ips = append(ips, peer.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return rcodeNXDomain, nil
+	}
+	return ipRecords(q.Type, ips)
+}
+
+// The A or AAAA records for the addresses, depending on the type asked
+// for. Invalid addresses are skipped.
+func ipRecords(qtype uint16, ips []string) (int, []record) {
+	var records []record
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+		case qtype == typeA && ip.To4() != nil:
+			records = append(records, record{Type: typeA, Data: ip.To4()})
+		case qtype == typeAAAA && ip.To4() == nil:
+			records = append(records, record{Type: typeAAAA, Data: ip.To16()})
+		}
+	}
+	return 0, records
+}
+
+func txtRecord(qtype uint16, txt string) (int, []record) {
+	if qtype != typeTXT {
+		return 0, nil
+	}
+
+	// A TXT record is made of strings of up to 255 bytes
+	// each, which resolvers join back together.
+	var data []byte
+	for len(txt) > 255 {
+		data = append(append(data, 255), txt[:255]...)
+		txt = txt[255:]
+	}
+	data = append(append(data, byte(len(txt))), txt...)
+	return 0, []record{{Type: typeTXT, Data: data}}
+}
+
+// Parse the first question, returning it and the offset of its end
+func parseQuestion(msg []byte) (q question, end int, err error) {
+	var labels []string
+	end = 12
+	for {
+		if end >= len(msg) {
+			return q, 0, errors.New("truncated name")
+		}
+		n := int(msg[end])
+		end++
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 || end+n > len(msg) {
+			return q, 0, fmt.Errorf("invalid label at %d", end-1)
+		}
+		labels = append(labels, string(msg[end:end+n]))
+		end += n
+	}
+	if end+4 > len(msg) {
+		return q, 0, errors.New("truncated question")
+	}
+
+	q.Name = strings.Join(labels, ".") + "."
+	q.Type = binary.BigEndian.Uint16(msg[end:])
+	q.Class = binary.BigEndian.Uint16(msg[end+2:])
+	return q, end + 4, nil
+}
+
+// A response to the query, echoing its ID, flags & the question that ends
+// at end. Answers point back to the question's name.
+func response(query []byte, end int, rcode int, answers []record) []byte {
+	// QR & AA, keeping the opcode & RD from the query
+	flags := 0x8400 | binary.BigEndian.Uint16(query[2:4])&0x7900 | uint16(rcode)
+	qdcount := uint16(0)
+	if end > 12 {
+		qdcount = 1
+	}
+
+	resp := make([]byte, 12, maxUDPSize)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], qdcount)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, query[12:end]...)
+
+	for _, a := range answers {
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, a.Type)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, devDNSTTL)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(a.Data)))
+		resp = append(resp, a.Data...)
+	}
+	return resp
+}
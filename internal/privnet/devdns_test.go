@@ -0,0 +1,197 @@
+package privnet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/privnet/privnettest"
+)
+
+const devPeers = `
+local_ip: fdaa:0:1::3
+apps:
+  nats:
+    peers:
+    - {alloc_id: 2f9a13b7c1d2e3, region: lhr, ip: "fdaa:0:1::2"}
+    - {alloc_id: 8d1e0c44f5a6b7, region: ams, ip: "fdaa:0:1::3"}
+  redis:
+    regions: [ord]
+    peers:
+    - {alloc_id: 5c3b2a19e8d7c6, region: ord, ip: 10.0.0.1}
+`
+
+func TestDevDNS(t *testing.T) {
+	ns, _ := privnettest.ServeDevDNS(t, devPeers)
+
+	checkDiscovery(t, privnet.NewFlyDNS(ns), "nats", discovered{
+		PeerIPs:  "[fdaa:0:1::2 fdaa:0:1::3]",
+		AllocIDs: []string{"2f9a13b7", "8d1e0c44"},
+		Regions:  []string{"ams", "lhr"},
+		LocalIP:  "fdaa:0:1::3",
+		Peers:    []string{"2f9a13b7 lhr fdaa:0:1::2", "8d1e0c44 ams fdaa:0:1::3"},
+	})
+
+	ctx := context.Background()
+	res := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "udp", ns)
+		},
+	}
+
+	for name, want := range map[string]string{
+		"redis.internal":                   "10.0.0.1",
+		"ams.nats.internal":                "fdaa:0:1::3",
+		"2f9a13b7.vm.nats.internal":        "fdaa:0:1::2",
+		"8D1E0C44F5A6B7.VM.NATS.INTERNAL.": "fdaa:0:1::3",
+		"fly-local-6pn":                    "fdaa:0:1::3",
+	} {
+		addrs, err := res.LookupIPAddr(ctx, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if addrs[0].IP.String() != want {
+			t.Errorf("%s: expected %s, got %v", name, want, addrs)
+		}
+	}
+
+	if apps, err := res.LookupTXT(ctx, "_apps.internal"); err != nil || len(apps) != 1 || apps[0] != "nats,redis" {
+		t.Errorf("expected nats,redis apps, got %v (%v)", apps, err)
+	}
+
+	for _, name := range []string{"missing.internal", "fra.nats.internal", "ffffffff.vm.nats.internal", "example.com"} {
+		_, err := res.LookupIPAddr(ctx, name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: expected not found, got %v", name, err)
+		}
+	}
+
+	// The local instance is in ams
+	nearest, err := privnet.NewFlyDNS(ns).Nearest(ctx, "nats", 1)
+	if err != nil || len(nearest) != 1 || nearest[0].AllocID != "8d1e0c44" || nearest[0].Region != "ams" {
+		t.Errorf("expected the nearest to be 8d1e0c44 in ams, got %v (%v)", nearest, err)
+	}
+	if nearest, err := privnet.NewFlyDNS(ns).Nearest(ctx, "nats", 0); err != nil || len(nearest) != 2 {
+		t.Errorf("expected both instances, got %v (%v)", nearest, err)
+	}
+
+	inRegion, err := privnet.NewFlyDNS(ns).RegionPeers(ctx, "nats", "ams")
+	if err != nil || len(inRegion) != 1 || inRegion[0].AllocID != "8d1e0c44" {
+		t.Errorf("expected 8d1e0c44 in ams, got %v (%v)", inRegion, err)
+	}
+	if inRegion, err := privnet.NewFlyDNS(ns).RegionPeers(ctx, "nats", "fra"); err != nil || len(inRegion) != 0 {
+		t.Errorf("expected no instances in fra, got %v (%v)", inRegion, err)
+	}
+}
+
+func TestFlyDNSOverIPv4(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peers.yml")
+	if err := os.WriteFile(file, []byte(devPeers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := privnet.ListenDevDNS("127.0.0.1:0", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+
+	checkDiscovery(t, privnet.NewFlyDNS(srv.Addr()), "redis", discovered{
+		PeerIPs:  "[10.0.0.1 fdaa:0:1::3]",
+		AllocIDs: []string{"5c3b2a19"},
+		Regions:  []string{"ord"},
+		LocalIP:  "fdaa:0:1::3",
+		Peers:    []string{"5c3b2a19 ord 10.0.0.1"},
+	})
+
+	_, err = privnet.NewFlyDNS(srv.Addr()).PeerIPs(context.Background(), "postgres")
+	if !privnet.IsNotFound(err) {
+		t.Errorf("expected postgres not to be found, got %v", err)
+	}
+}
+
+func TestFlyDNSRetries(t *testing.T) {
+	// A nameserver that counts queries, without ever answering
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	queries := make(chan struct{}, 100)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			queries <- struct{}{}
+		}
+	}()
+
+	fly := privnet.NewFlyDNS(conn.LocalAddr().String())
+	fly.Queries = privnet.QueryOptions{Timeout: 100 * time.Millisecond, Retries: 1}
+
+	start := time.Now()
+	_, err = fly.Regions(context.Background(), "nats")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to give up after 2 attempts, took %s", elapsed)
+	}
+	if len(queries) < 2 {
+		t.Errorf("expected the query to be retried, got %d queries", len(queries))
+	}
+}
+
+func TestDevDNSTruncates(t *testing.T) {
+	peers := "apps:\n  nats:\n    peers:\n"
+	for i := 1; i <= 30; i++ {
+		peers += fmt.Sprintf("    - {alloc_id: %08x, region: lhr, ip: \"fdaa:0:1::%x\"}\n", i, i)
+	}
+	ns, _ := privnettest.ServeDevDNS(t, peers)
+
+	conn, err := net.Dial("udp", ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// An AAAA query for nats.internal, with an EDNS buffer size if given
+	query := func(size uint16) []byte {
+		msg := []byte{0xbe, 0xef, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+		msg = append(msg, "\x04nats\x08internal\x00\x00\x1c\x00\x01"...)
+		if size > 0 {
+			msg[11] = 1
+			msg = append(msg, 0, 0, 41, byte(size>>8), byte(size), 0, 0, 0, 0, 0, 0)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp[:n]
+	}
+
+	// 30 answers don't fit in 512 bytes
+	resp := query(0)
+	if len(resp) > 512 || resp[2]&0x02 == 0 || resp[7] != 0 {
+		t.Errorf("expected a truncated response without answers, got %d bytes, flags %08b", len(resp), resp[2])
+	}
+	resp = query(4096)
+	if resp[2]&0x02 != 0 || resp[7] != 30 {
+		t.Errorf("expected all 30 answers, got %d, flags %08b", resp[7], resp[2])
+	}
+}
@@ -0,0 +1,200 @@
+package privnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrUnknownDiscovery = errors.New("unknown discovery type")
+
+// A Discovery finds the instances of an app, and the regions it's
+// deployed in. On Fly, that's done with the .internal DNS records; other
+// implementations let the same procfly.yml run locally, in CI and in
+// docker-compose.
+type Discovery interface {
+	// The private IP addresses of the app's instances
+	PeerIPs(ctx context.Context, app string) ([]net.IP, error)
+	// The allocation IDs of the app's instances
+	AllocIDs(ctx context.Context, app string) ([]string, error)
+	// The regions the app is deployed in
+	Regions(ctx context.Context, app string) ([]string, error)
+	// This instance's private IP address
+	LocalIP(ctx context.Context) (net.IP, error)
+	// The app's instances, with their regions & addresses where
+	// they're known
+	Peers(ctx context.Context, app string) ([]Peer, error)
+	// The app's instances in the region, which is empty if it has
+	// none there
+	RegionPeers(ctx context.Context, app, region string) ([]Peer, error)
+	// Up to n of the app's nearest instances, or all of them if n isn't
+	// positive. On Fly, that's by latency, though they aren't returned
+	// in order; elsewhere, the instances in this one's region come first.
+	Nearest(ctx context.Context, app string, n int) ([]Peer, error)
+}
+
+// An instance of an app
+type Peer struct {
+	// Empty if it isn't known
+	AllocID string
+	// Empty if it isn't known
+	Region string
+	// Nil if it isn't known
+	IP net.IP
+}
+
+// The 8 character prefix of an allocation ID, which is used in
+// Fly's VM DNS. Shorter IDs are left as they are.
+func ShortAllocID(allocID string) string {
+	if len(allocID) > 8 {
+		return allocID[:8]
+	}
+	return allocID
+}
+
+// The region of every peer, if the app is only in one
+func onlyRegion(regions []string) string {
+	if len(regions) == 1 {
+		return regions[0]
+	}
+	return ""
+}
+
+// RegionPeers, for discoveries that know each instance's region
+func regionPeers(ctx context.Context, disc Discovery, app, region string) ([]Peer, error) {
+	peers, err := disc.Peers(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	inRegion := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		if strings.EqualFold(peer.Region, region) {
+			inRegion = append(inRegion, peer)
+		}
+	}
+	return inRegion, nil
+}
+
+// Nearest, for discoveries that only know the instances' regions
+func nearestPeers(ctx context.Context, disc Discovery, app string, n int) ([]Peer, error) {
+	peers, err := disc.Peers(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	local, err := disc.LocalIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nearest(peers, local, n), nil
+}
+
+// Up to n of the peers, with those in the same region as local first
+func nearest(peers []Peer, local net.IP, n int) []Peer {
+	var region string
+	for _, peer := range peers {
+		if peer.IP.Equal(local) {
+			region = peer.Region
+			break
+		}
+	}
+	if region != "" {
+		sort.SliceStable(peers, func(i, j int) bool {
+			return peers[i].Region == region && peers[j].Region != region
+		})
+	}
+	if n > 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+type DiscoveryConfig struct {
+	// One of fly, static, dns or env. Defaults to fly.
+	Type string `yaml:"type"`
+	// The app that this instance belongs to, when FLY_APP_NAME isn't set.
+	// Without either, the instance runs alone, without any discovery.
+	App string `yaml:"app"`
+	// For fly & dns discovery, the nameserver's address. Fly defaults to
+	// FLY_NAMESERVER or fdaa::3, and dns to the system's resolver.
+	Nameserver string `yaml:"nameserver"`
+	// For static discovery, a YAML or JSON file of apps & their peers
+	File string `yaml:"file"`
+	// For dns discovery, an SRV record to look up each app's instances
+	// with, such as _peers._tcp. Without one, the app's name is looked
+	// up directly, and each address is its own allocation ID.
+	Service string `yaml:"service"`
+	// For dns discovery, the regions that every app is deployed in.
+	// Defaults to local.
+	Regions []string `yaml:"regions"`
+	// For env discovery, the prefix of the environment variables
+	// listing each app's peers. Defaults to PROCFLY_.
+	Prefix string `yaml:"prefix"`
+	// How long discovered peers are cached for. Defaults to 15s.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// How long the last discovered peers are used for while discovery
+	// is failing, before procfly gives up. Defaults to 5m.
+	MaxStale time.Duration `yaml:"max_stale"`
+	// For fly & dns discovery, how long each DNS query may take, where
+	// 0 doesn't time them out. Defaults to 2s.
+	Timeout *time.Duration `yaml:"timeout"`
+	// For fly & dns discovery, how many times a DNS query is retried
+	// after it fails or times out, where 0 doesn't retry them. Defaults
+	// to 2.
+	Retries *int `yaml:"retries"`
+}
+
+// The app this instance belongs to, if any
+func (c DiscoveryConfig) AppName() string {
+	if app := os.Getenv("FLY_APP_NAME"); app != "" {
+		return app
+	}
+	return c.App
+}
+
+// Open the configured discovery. Relative files are resolved against dir.
+func (c DiscoveryConfig) Open(dir string) (Discovery, error) {
+	switch c.Type {
+	case "", "fly":
+		fly := NewFlyDNS(c.Nameserver)
+		fly.Queries = c.QueryOptions()
+		return fly, nil
+	case "static":
+		if c.File == "" {
+			return nil, errors.New("static discovery needs a file")
+		}
+		return NewStaticDiscovery(resolve(dir, c.File)), nil
+	case "dns":
+		dns := NewDNSDiscovery(c.Nameserver, c.Service, c.Regions)
+		dns.Queries = c.QueryOptions()
+		return dns, nil
+	case "env":
+		return NewEnvDiscovery(c.Prefix), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDiscovery, c.Type)
+	}
+}
+
+// How DNS queries are made, for fly & dns discovery
+func (c DiscoveryConfig) QueryOptions() QueryOptions {
+	opts := DefaultQueryOptions()
+	if c.Timeout != nil {
+		opts.Timeout = *c.Timeout
+	}
+	if c.Retries != nil {
+		opts.Retries = *c.Retries
+	}
+	return opts
+}
+
+func resolve(dir, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
@@ -0,0 +1,132 @@
+package privnet_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/privnet"
+	"gopkg.in/yaml.v3"
+)
+
+func TestStaticDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "peers.yml"), []byte(`
+local_ip: 10.0.0.1
+apps:
+  nats:
+    peers:
+    - {alloc_id: 2f9a13b7, region: lhr, ip: 10.0.0.1}
+    - {alloc_id: 8d1e0c44, region: ams, ip: 10.0.0.2}
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	disc, err := privnet.DiscoveryConfig{Type: "static", File: "peers.yml"}.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDiscovery(t, disc, "nats", discovered{
+		PeerIPs:  "[10.0.0.1 10.0.0.2]",
+		AllocIDs: []string{"2f9a13b7", "8d1e0c44"},
+		Regions:  []string{"ams", "lhr"},
+		LocalIP:  "10.0.0.1",
+		Peers:    []string{"2f9a13b7 lhr 10.0.0.1", "8d1e0c44 ams 10.0.0.2"},
+	})
+
+	if _, err := disc.PeerIPs(context.Background(), "missing"); err == nil {
+		t.Error("expected an error for a missing app")
+	}
+}
+
+func TestEnvDiscovery(t *testing.T) {
+	t.Setenv("PROCFLY_MY_APP_PEER_IPS", "fdaa::1, fdaa::2")
+	t.Setenv("PROCFLY_MY_APP_REGIONS", "lhr")
+	t.Setenv("PROCFLY_LOCAL_IP", "fdaa::1")
+
+	disc, err := privnet.DiscoveryConfig{Type: "env"}.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDiscovery(t, disc, "my-app", discovered{
+		PeerIPs:  "[fdaa::1 fdaa::2]",
+		AllocIDs: []string{"fdaa::1", "fdaa::2"},
+		Regions:  []string{"lhr"},
+		LocalIP:  "fdaa::1",
+		Peers:    []string{" lhr fdaa::1", " lhr fdaa::2"},
+	})
+}
+
+func TestUnknownDiscovery(t *testing.T) {
+	if _, err := (privnet.DiscoveryConfig{Type: "consul"}).Open("."); !errors.Is(err, privnet.ErrUnknownDiscovery) {
+		t.Errorf("expected ErrUnknownDiscovery, got %v", err)
+	}
+}
+
+type discovered struct {
+	PeerIPs  string
+	AllocIDs []string
+	Regions  []string
+	LocalIP  string
+	// Each as "alloc region ip"
+	Peers []string
+}
+
+func checkDiscovery(t *testing.T, disc privnet.Discovery, app string, want discovered) {
+	t.Helper()
+	ctx := context.Background()
+
+	var got discovered
+	ips, err := disc.PeerIPs(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.PeerIPs = fmt.Sprint(ips)
+	if got.AllocIDs, err = disc.AllocIDs(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	if got.Regions, err = disc.Regions(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	local, err := disc.LocalIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.LocalIP = local.String()
+	peers, err := disc.Peers(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		got.Peers = append(got.Peers, fmt.Sprintf("%s %s %s", peer.AllocID, peer.Region, peer.IP))
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDiscoveryConfigQueries(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want privnet.QueryOptions
+	}{
+		{`type: fly`, privnet.DefaultQueryOptions()},
+		{`{timeout: 500ms, retries: 5}`, privnet.QueryOptions{Timeout: 500 * time.Millisecond, Retries: 5}},
+		// Zero turns them off, rather than using the defaults
+		{`{timeout: 0s, retries: 0}`, privnet.QueryOptions{}},
+	} {
+		var conf privnet.DiscoveryConfig
+		if err := yaml.Unmarshal([]byte(tt.conf), &conf); err != nil {
+			t.Fatal(err)
+		}
+		if got := conf.QueryOptions(); got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.conf, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package privnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+)
+
+// Discovery through plain DNS, against any resolver, such as docker's
+// embedded DNS server. An app's instances are either the addresses its
+// name resolves to, or the targets of an SRV record.
+type DNSDiscovery struct {
+	nameserver string
+	service    string
+	regions    []string
+	// How queries are timed out & retried
+	Queries QueryOptions
+}
+
+// Use the given nameserver, or the system's resolver if it's empty. If the
+// service is set, it's prefixed to the app's name to look up SRV records.
+func NewDNSDiscovery(nameserver, service string, regions []string) *DNSDiscovery {
+	if len(regions) == 0 {
+		regions = []string{"local"}
+	}
+	return &DNSDiscovery{nameserver: nameserver, service: service, regions: regions, Queries: DefaultQueryOptions()}
+}
+
+func (d *DNSDiscovery) PeerIPs(ctx context.Context, app string) ([]net.IP, error) {
+	hosts, err := d.hosts(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, host := range hosts {
+		addrs, err := d.lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, nil
+}
+
+// The first label of each SRV target, or each of the app's addresses
+func (d *DNSDiscovery) AllocIDs(ctx context.Context, app string) ([]string, error) {
+	if d.service == "" {
+		ips, err := d.PeerIPs(ctx, app)
+		allocIDs := make([]string, len(ips))
+		for i, ip := range ips {
+			allocIDs[i] = ip.String()
+		}
+		return allocIDs, err
+	}
+
+	hosts, err := d.hosts(ctx, app)
+	allocIDs := make([]string, len(hosts))
+	for i, host := range hosts {
+		allocIDs[i], _, _ = strings.Cut(host, ".")
+	}
+	return allocIDs, err
+}
+
+// Each SRV target, or each of the app's addresses, whose alloc IDs
+// aren't known. Their regions are only known if the app is in just one.
+func (d *DNSDiscovery) Peers(ctx context.Context, app string) ([]Peer, error) {
+	hosts, err := d.hosts(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []Peer
+	for _, host := range hosts {
+		addrs, err := d.lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			peer := Peer{Region: onlyRegion(d.regions), IP: addr.IP}
+			if d.service != "" {
+				peer.AllocID, _, _ = strings.Cut(host, ".")
+			}
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+func (d *DNSDiscovery) RegionPeers(ctx context.Context, app, region string) ([]Peer, error) {
+	return regionPeers(ctx, d, app, region)
+}
+
+func (d *DNSDiscovery) Nearest(ctx context.Context, app string, n int) ([]Peer, error) {
+	return nearestPeers(ctx, d, app, n)
+}
+
+func (d *DNSDiscovery) Regions(ctx context.Context, app string) ([]string, error) {
+	return d.regions, nil
+}
+
+// The addresses this machine's hostname resolves to
+func (d *DNSDiscovery) LocalIP(ctx context.Context) (net.IP, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := d.lookupIPAddr(ctx, hostname)
+	if err != nil || len(addrs) == 0 {
+		return net.ParseIP("127.0.0.1"), nil
+	}
+	return addrs[0].IP, nil
+}
+
+// The hostnames to resolve for the app's instances
+func (d *DNSDiscovery) hosts(ctx context.Context, app string) ([]string, error) {
+	if d.service == "" {
+		return []string{app}, nil
+	}
+
+	srvs, err := query(ctx, d.Queries, func(ctx context.Context) ([]*net.SRV, error) {
+		_, srvs, err := d.resolver().LookupSRV(ctx, "", "", d.service+"."+app)
+		return srvs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(srvs))
+	for i, srv := range srvs {
+		hosts[i] = srv.Target
+	}
+	return hosts, nil
+}
+
+func (d *DNSDiscovery) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return query(ctx, d.Queries, func(ctx context.Context) ([]net.IPAddr, error) {
+		return d.resolver().LookupIPAddr(ctx, host)
+	})
+}
+
+func (d *DNSDiscovery) resolver() *net.Resolver {
+	if d.nameserver == "" {
+		return net.DefaultResolver
+	}
+	return nameserverResolver(d.Queries, d.nameserver)
+}
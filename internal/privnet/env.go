@@ -0,0 +1,116 @@
+package privnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Discovery from lists in environment variables, named after each app.
+// With the default prefix, the "my-app" app's instances are listed in
+// PROCFLY_MY_APP_PEER_IPS, PROCFLY_MY_APP_ALLOC_IDS and PROCFLY_MY_APP_REGIONS,
+// separated by commas or spaces. Alloc IDs default to the peers' addresses,
+// and regions to local. This instance's address is in PROCFLY_LOCAL_IP.
+type EnvDiscovery struct {
+	prefix string
+}
+
+func NewEnvDiscovery(prefix string) *EnvDiscovery {
+	if prefix == "" {
+		prefix = "PROCFLY_"
+	}
+	return &EnvDiscovery{prefix: prefix}
+}
+
+func (e *EnvDiscovery) PeerIPs(ctx context.Context, app string) ([]net.IP, error) {
+	name := e.varName(app, "PEER_IPS")
+	values := e.list(name)
+	ips := make([]net.IP, 0, len(values))
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid ip %q", name, value)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (e *EnvDiscovery) AllocIDs(ctx context.Context, app string) ([]string, error) {
+	if allocIDs := e.list(e.varName(app, "ALLOC_IDS")); len(allocIDs) > 0 {
+		return allocIDs, nil
+	}
+	return e.list(e.varName(app, "PEER_IPS")), nil
+}
+
+// The peers' addresses, paired with the alloc IDs if there are as many.
+// Otherwise, their alloc IDs aren't known. Their regions are only known
+// if the app is in just one.
+func (e *EnvDiscovery) Peers(ctx context.Context, app string) ([]Peer, error) {
+	ips, err := e.PeerIPs(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	allocIDs := e.list(e.varName(app, "ALLOC_IDS"))
+	regions, _ := e.Regions(ctx, app)
+
+	peers := make([]Peer, len(ips))
+	for i, ip := range ips {
+		peers[i] = Peer{Region: onlyRegion(regions), IP: ip}
+		if len(allocIDs) == len(ips) {
+			peers[i].AllocID = allocIDs[i]
+		}
+	}
+	return peers, nil
+}
+
+func (e *EnvDiscovery) RegionPeers(ctx context.Context, app, region string) ([]Peer, error) {
+	return regionPeers(ctx, e, app, region)
+}
+
+func (e *EnvDiscovery) Nearest(ctx context.Context, app string, n int) ([]Peer, error) {
+	return nearestPeers(ctx, e, app, n)
+}
+
+func (e *EnvDiscovery) Regions(ctx context.Context, app string) ([]string, error) {
+	if regions := e.list(e.varName(app, "REGIONS")); len(regions) > 0 {
+		return regions, nil
+	}
+	return []string{"local"}, nil
+}
+
+func (e *EnvDiscovery) LocalIP(ctx context.Context) (net.IP, error) {
+	value := os.Getenv(e.prefix + "LOCAL_IP")
+	if value == "" {
+		return net.ParseIP("127.0.0.1"), nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("%sLOCAL_IP: invalid ip %q", e.prefix, value)
+	}
+	return ip, nil
+}
+
+// The variable's name, for the app. Characters that can't
+// be used in variable names are replaced with underscores.
+func (e *EnvDiscovery) varName(app, suffix string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, app)
+	return e.prefix + name + "_" + suffix
+}
+
+func (e *EnvDiscovery) list(name string) []string {
+	return strings.FieldsFunc(os.Getenv(name), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
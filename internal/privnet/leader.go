@@ -0,0 +1,278 @@
+package privnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownLeaderMode = errors.New("unknown leader mode")
+	ErrLeaseLocked       = errors.New("lease is locked")
+)
+
+const DefaultLeaseTTL = 15 * time.Second
+
+// An Elector decides whether this instance leads its app. It's asked on
+// every refresh, so leadership moves as instances come & go.
+type Elector interface {
+	// Whether self leads, out of the IDs of every peer, which are
+	// their allocation IDs, or their addresses when those aren't known
+	Elect(self string, peers []string) (bool, error)
+	// Give up leadership, if it's held, such as when shutting down
+	Resign() error
+}
+
+type LeaderConfig struct {
+	// With peers, the instance with the lowest allocation ID, or address
+	// for instances that are only known by their address, leads. It
+	// needs nothing shared, but instances may briefly disagree while
+	// discovery catches up with them. With lease, the instance holding
+	// a lease file on storage shared by every instance leads. Defaults
+	// to peers.
+	Mode string `yaml:"mode"`
+	// For lease mode, the lease file
+	File string `yaml:"file"`
+	// For lease mode, how long a lease lasts without being renewed.
+	// It's renewed in the background every third of the TTL, as well
+	// as on every refresh. Defaults to 15s.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Open the configured elector. Relative files are resolved against dir.
+func (c LeaderConfig) Open(dir string) (Elector, error) {
+	switch c.Mode {
+	case "", "peers":
+		return PeersElector{}, nil
+	case "lease":
+		if c.File == "" {
+			return nil, errors.New("lease mode needs a file")
+		}
+		return NewLeaseElector(resolve(dir, c.File), c.TTL), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownLeaderMode, c.Mode)
+	}
+}
+
+// Elects the instance with the lowest allocation ID
+type PeersElector struct{}
+
+func (PeersElector) Elect(self string, peers []string) (bool, error) {
+	for _, peer := range peers {
+		if peer < self {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (PeersElector) Resign() error {
+	return nil
+}
+
+// Elects the instance holding a lease, which is a JSON file naming its
+// holder and when it expires. Leases are compared with each instance's
+// own clock, so clocks shouldn't drift by much of the TTL. A held lease
+// is renewed in the background, so that it isn't lost while refreshes
+// are slow.
+type LeaseElector struct {
+	file string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	self    string
+	renewed time.Time
+	// Closed to stop renewing the lease
+	stop chan struct{}
+}
+
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func NewLeaseElector(file string, ttl time.Duration) *LeaseElector {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &LeaseElector{file: file, ttl: ttl}
+}
+
+// Take or renew the lease, unless another instance holds it. If the lease
+// can't be read or written, a lease that was held is kept until it expires.
+func (l *LeaseElector) Elect(self string, peers []string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.self = self
+	held, err := l.acquire(self)
+	if err != nil {
+		return !l.renewed.IsZero() && time.Since(l.renewed) < l.ttl, err
+	}
+	if held {
+		l.renewed = time.Now()
+		if l.stop == nil {
+			l.stop = make(chan struct{})
+			go l.renew(l.stop)
+		}
+	} else {
+		l.renewed = time.Time{}
+		l.stopRenewing()
+	}
+	return held, nil
+}
+
+// Renew the lease every third of the TTL, until stop is closed. As with
+// Elect, a lease that can't be renewed is kept until it expires.
+func (l *LeaseElector) renew(stop chan struct{}) {
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		l.mu.Lock()
+		select {
+		case <-stop:
+			// Resigned while waiting for the lock
+			l.mu.Unlock()
+			return
+		default:
+		}
+		if held, err := l.acquire(l.self); err == nil && held {
+			l.renewed = time.Now()
+		} else if err == nil {
+			l.renewed = time.Time{}
+			l.stopRenewing()
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *LeaseElector) stopRenewing() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+func (l *LeaseElector) Resign() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopRenewing()
+	if l.renewed.IsZero() {
+		return nil
+	}
+	l.renewed = time.Time{}
+
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil || current.Holder != l.self {
+		return err
+	}
+	return os.Remove(l.file)
+}
+
+func (l *LeaseElector) acquire(self string) (bool, error) {
+	unlock, err := l.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != self && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	data, err := json.Marshal(lease{Holder: self, Expires: time.Now().Add(l.ttl)})
+	if err != nil {
+		return false, err
+	}
+
+	// Written alongside, then renamed over the lease,
+	// so that it's never seen half-written.
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), "."+filepath.Base(l.file))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), l.file)
+}
+
+// The current lease, which is empty if there isn't one
+func (l *LeaseElector) read() (lease, error) {
+	var current lease
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return current, nil
+	} else if err != nil {
+		return current, err
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return current, fmt.Errorf("%s: %w", l.file, err)
+	}
+	return current, nil
+}
+
+// Lock the lease while it's read & written, with a file that only one
+// instance can create. A lock left behind by a crashed instance is
+// broken once it's older than the TTL.
+func (l *LeaseElector) lock() (unlock func(), err error) {
+	path := l.file + ".lock"
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		} else if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > l.ttl {
+			breakLock(path, info)
+			continue
+		}
+		if attempt == 10 {
+			return nil, fmt.Errorf("%s: %w", l.file, ErrLeaseLocked)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Break a stale lock. Another instance may have broken it & taken the
+// lock since it was found, so it's moved aside first, and only removed
+// if it's still the stale lock. Otherwise, it's put back.
+func breakLock(path string, stale fs.FileInfo) {
+	aside := fmt.Sprintf("%s.%d.%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		return
+	}
+	if info, err := os.Stat(aside); err == nil && !os.SameFile(info, stale) {
+		_ = os.Link(aside, path)
+	}
+	os.Remove(aside)
+}
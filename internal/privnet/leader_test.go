@@ -0,0 +1,105 @@
+package privnet_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/privnet"
+)
+
+func TestPeersElector(t *testing.T) {
+	peers := []string{"8d1e0c44", "2f9a13b7", "e1d2c3b4"}
+	for self, want := range map[string]bool{
+		"2f9a13b7": true,
+		"8d1e0c44": false,
+		"e1d2c3b4": false,
+		// Not discovered yet, but still the lowest
+		"0a1b2c3d": true,
+	} {
+		if leader, err := (privnet.PeersElector{}).Elect(self, peers); err != nil || leader != want {
+			t.Errorf("%s: expected %t, got %t (%v)", self, want, leader, err)
+		}
+	}
+}
+
+func TestLeaseElector(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.json")
+	conf := privnet.LeaderConfig{Mode: "lease", File: file, TTL: 300 * time.Millisecond}
+	a, err := conf.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := conf.Open(".")
+	t.Cleanup(func() {
+		a.Resign()
+		b.Resign()
+	})
+
+	elect := func(e privnet.Elector, self string, want bool) {
+		t.Helper()
+		if leader, err := e.Elect(self, nil); err != nil || leader != want {
+			t.Fatalf("%s: expected %t, got %t (%v)", self, want, leader, err)
+		}
+	}
+
+	// The first to ask takes the lease, and renews it
+	elect(a, "a", true)
+	elect(b, "b", false)
+	elect(a, "a", true)
+
+	// Resigning hands it over straight away
+	if err := a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	elect(b, "b", true)
+	elect(a, "a", false)
+
+	// A held lease is renewed between elections
+	time.Sleep(500 * time.Millisecond)
+	elect(a, "a", false)
+	elect(b, "b", true)
+
+	// A lease left by a crashed instance expires
+	if err := b.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	expired := fmt.Sprintf(`{"holder": "c", "expires": %q}`, time.Now().Add(-time.Second).Format(time.RFC3339Nano))
+	if err := os.WriteFile(file, []byte(expired), 0644); err != nil {
+		t.Fatal(err)
+	}
+	elect(a, "a", true)
+	elect(b, "b", false)
+}
+
+func TestLeaseElectorStaleLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leader.json")
+	e := privnet.NewLeaseElector(file, 100*time.Millisecond)
+
+	// A lock left behind by a crashed instance is broken
+	if err := os.WriteFile(file+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-time.Second)
+	if err := os.Chtimes(file+".lock", stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := e.Elect("a", nil); err != nil || !leader {
+		t.Fatalf("expected the stale lock to be broken, got %t (%v)", leader, err)
+	}
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(file + ".lock*"); len(matches) != 0 {
+		t.Errorf("expected the locks to be removed, got %v", matches)
+	}
+}
+
+func TestUnknownLeaderMode(t *testing.T) {
+	if _, err := (privnet.LeaderConfig{Mode: "raft"}).Open("."); !errors.Is(err, privnet.ErrUnknownLeaderMode) {
+		t.Errorf("expected ErrUnknownLeaderMode, got %v", err)
+	}
+}
@@ -6,38 +6,144 @@ import (
 	"net"
 	"os"
 	"strings"
-	"time"
 )
 
+// Fly's nameserver, on the 6PN
+const flyNameserver = "fdaa::3"
+
+// Discovery through Fly's .internal DNS records
+type FlyDNS struct {
+	nameserver string
+	// How queries are timed out & retried
+	Queries QueryOptions
+}
+
+// Use the given nameserver, or FLY_NAMESERVER. Without either, fdaa::3 is
+// used on Fly, and elsewhere the nameservers in /etc/resolv.conf, which is
+// where docker's and CI's are. Nameservers may be IPv4 or IPv6 addresses.
+func NewFlyDNS(nameserver string) *FlyDNS {
+	return &FlyDNS{nameserver: nameserver, Queries: DefaultQueryOptions()}
+}
+
 // Look up the 6PN addresses for all instances of the given app
-func AllPeerIPs(ctx context.Context, appName string) ([]net.IPAddr, error) {
-	return Get6PN(ctx, fmt.Sprintf("%s.internal", appName))
+func (f *FlyDNS) PeerIPs(ctx context.Context, appName string) ([]net.IP, error) {
+	addrs, err := f.get6PN(ctx, f.resolver(), fmt.Sprintf("%s.internal", appName))
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, err
 }
 
 // Load all allocation IDs from the vms.{app}.internal DNS record
-func AllPeerAllocIDs(ctx context.Context, appName string) ([]string, error) {
-	records, err := newResolver().LookupTXT(ctx, fmt.Sprintf("vms.%s.internal", appName))
+func (f *FlyDNS) AllocIDs(ctx context.Context, appName string) ([]string, error) {
+	vms, err := f.vms(ctx, f.resolver(), appName)
+	allocIDs := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		allocIDs = append(allocIDs, vm.AllocID)
+	}
+	return allocIDs, err
+}
+
+// Load each instance from the vms.{app}.internal DNS record, with its
+// address from {alloc}.vm.{app}.internal
+func (f *FlyDNS) Peers(ctx context.Context, appName string) ([]Peer, error) {
+	res := f.resolver()
+	peers, err := f.vms(ctx, res, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, peer := range peers {
+		addrs, err := f.lookupIPAddr(ctx, res, fmt.Sprintf("%s.vm.%s.internal", peer.AllocID, appName))
+		if err != nil && !IsNotFound(err) {
+			return nil, err
+		}
+		if len(addrs) > 0 {
+			peers[i].IP = addrs[0].IP
+		}
+	}
+	return peers, nil
+}
+
+// Look up the {region}.{app}.internal DNS record, matching each address
+// with an instance where it can
+func (f *FlyDNS) RegionPeers(ctx context.Context, appName, region string) ([]Peer, error) {
+	res := f.resolver()
+	peers, err := f.Peers(ctx, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := f.lookupIPAddr(ctx, res, fmt.Sprintf("%s.%s.internal", region, appName))
+	if IsNotFound(err) {
+		return []Peer{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return matchPeers(addrs, peers), nil
+}
+
+// Look up the top{n}.nearest.of.{app}.internal DNS record, matching each
+// address with an instance where it can. Fly needs n to be set, so all of
+// the app's instances are asked for without it. Go's resolver sorts the
+// addresses it's given, so they aren't in order of latency.
+func (f *FlyDNS) Nearest(ctx context.Context, appName string, n int) ([]Peer, error) {
+	res := f.resolver()
+	peers, err := f.Peers(ctx, appName)
 	if err != nil {
 		return nil, err
 	}
+	if n <= 0 {
+		n = len(peers)
+	}
 
-	allocIDs := make([]string, 0)
+	addrs, err := f.lookupIPAddr(ctx, res, fmt.Sprintf("top%d.nearest.of.%s.internal", n, appName))
+	if err != nil {
+		return nil, err
+	}
+	return matchPeers(addrs, peers), nil
+}
+
+// The instance at each address, or just the address if it isn't a peer
+func matchPeers(addrs []net.IPAddr, peers []Peer) []Peer {
+	matched := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		matched[i] = Peer{IP: addr.IP}
+		for _, peer := range peers {
+			if peer.IP.Equal(addr.IP) {
+				matched[i] = peer
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// The alloc IDs & regions in the vms.{app}.internal DNS record
+func (f *FlyDNS) vms(ctx context.Context, res *net.Resolver, appName string) ([]Peer, error) {
+	records, err := f.lookupTXT(ctx, res, fmt.Sprintf("vms.%s.internal", appName))
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]Peer, 0)
 	for _, record := range records {
 		for _, alloc := range strings.Split(record, ",") {
-			allocID, _, ok := strings.Cut(alloc, " ")
+			allocID, region, ok := strings.Cut(strings.TrimSpace(alloc), " ")
 			if ok {
 				// We should truncate the alloc IDs to the 8 character
 				// prefix that is used in fly's VM DNS.
-				allocIDs = append(allocIDs, allocID[:8])
+				vms = append(vms, Peer{AllocID: ShortAllocID(allocID), Region: region})
 			}
 		}
 	}
-	return allocIDs, nil
+	return vms, nil
 }
 
 // Load all regions the app is deployed in, from the regions.{app}.internal DNS record
-func GetRegions(ctx context.Context, appName string) ([]string, error) {
-	records, err := newResolver().LookupTXT(ctx, fmt.Sprintf("regions.%s.internal", appName))
+func (f *FlyDNS) Regions(ctx context.Context, appName string) ([]string, error) {
+	records, err := f.lookupTXT(ctx, f.resolver(), fmt.Sprintf("regions.%s.internal", appName))
 	if err != nil {
 		return nil, err
 	}
@@ -49,15 +155,31 @@ func GetRegions(ctx context.Context, appName string) ([]string, error) {
 	return regions, nil
 }
 
-func Get6PN(ctx context.Context, hostname string) ([]net.IPAddr, error) {
-	res := newResolver()
-	ips, err := res.LookupIPAddr(ctx, hostname)
+// Look up fly-local-6pn, which is in /etc/hosts on Fly, falling back to
+// the nameserver, and then to 127.0.0.1
+func (f *FlyDNS) LocalIP(ctx context.Context) (net.IP, error) {
+	addrs, err := f.lookupIPAddr(ctx, f.resolver(), "fly-local-6pn")
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+
+	if len(addrs) > 0 {
+		return addrs[0].IP, nil
+	}
+	return net.ParseIP("127.0.0.1"), nil
+}
+
+func (f *FlyDNS) get6PN(ctx context.Context, res *net.Resolver, hostname string) ([]net.IPAddr, error) {
+	ips, err := f.lookupIPAddr(ctx, res, hostname)
 	if err != nil {
 		return ips, err
 	}
 
 	// make sure we're including the local ip, just in case it's not in service discovery yet
-	local, err := res.LookupIPAddr(ctx, "fly-local-6pn")
+	local, err := f.lookupIPAddr(ctx, res, "fly-local-6pn")
+	if IsNotFound(err) {
+		return ips, nil
+	}
 	if err != nil || len(local) < 1 {
 		return ips, err
 	}
@@ -75,9 +197,66 @@ func Get6PN(ctx context.Context, hostname string) ([]net.IPAddr, error) {
 	return ips, err
 }
 
+func (f *FlyDNS) lookupIPAddr(ctx context.Context, res *net.Resolver, host string) ([]net.IPAddr, error) {
+	return query(ctx, f.Queries, func(ctx context.Context) ([]net.IPAddr, error) {
+		return res.LookupIPAddr(ctx, host)
+	})
+}
+
+func (f *FlyDNS) lookupTXT(ctx context.Context, res *net.Resolver, name string) ([]string, error) {
+	return query(ctx, f.Queries, func(ctx context.Context) ([]string, error) {
+		return res.LookupTXT(ctx, name)
+	})
+}
+
+func (f *FlyDNS) resolver() *net.Resolver {
+	// We can use this DNS resolver to look up fly-based DNS
+	// records. This can be used for clustering information
+	return nameserverResolver(f.Queries, f.nameservers()...)
+}
+
+// The configured nameserver, or FLY_NAMESERVER, or Fly's own when running
+// on Fly. Elsewhere, fdaa::3 is usually unreachable, especially without
+// IPv6, so the system's nameservers are tried first.
+func (f *FlyDNS) nameservers() []string {
+	if f.nameserver != "" {
+		return []string{f.nameserver}
+	}
+	if nameserver := os.Getenv("FLY_NAMESERVER"); nameserver != "" {
+		return []string{nameserver}
+	}
+	if os.Getenv("FLY_ALLOC_ID") != "" {
+		return []string{flyNameserver}
+	}
+	return append(systemNameservers(resolvConf), flyNameserver)
+}
+
+// Look up the 6PN addresses for all instances of the given app
+func AllPeerIPs(ctx context.Context, appName string) ([]net.IPAddr, error) {
+	return Get6PN(ctx, fmt.Sprintf("%s.internal", appName))
+}
+
+// Load all allocation IDs from the vms.{app}.internal DNS record
+func AllPeerAllocIDs(ctx context.Context, appName string) ([]string, error) {
+	return NewFlyDNS("").AllocIDs(ctx, appName)
+}
+
+// Load all regions the app is deployed in, from the regions.{app}.internal DNS record
+func GetRegions(ctx context.Context, appName string) ([]string, error) {
+	return NewFlyDNS("").Regions(ctx, appName)
+}
+
+func Get6PN(ctx context.Context, hostname string) ([]net.IPAddr, error) {
+	f := NewFlyDNS("")
+	return f.get6PN(ctx, f.resolver(), hostname)
+}
+
+// This instance's 6PN address, from /etc/hosts or the system's resolver,
+// falling back to 127.0.0.1 when it doesn't exist. Other failures, such
+// as timeouts, are returned.
 func PrivateIPv6() (net.IP, error) {
 	ips, err := net.LookupIP("fly-local-6pn")
-	if err != nil && !strings.HasSuffix(err.Error(), "no such host") && !strings.HasSuffix(err.Error(), "server misbehaving") {
+	if err != nil && !IsNotFound(err) {
 		return nil, err
 	}
 
@@ -87,25 +266,3 @@ func PrivateIPv6() (net.IP, error) {
 
 	return net.ParseIP("127.0.0.1"), nil
 }
-
-func newResolver() *net.Resolver {
-	// Get the nameserver to use from the environment
-	// or fall back to fdaa::3
-	nameserver := os.Getenv("FLY_NAMESERVER")
-	if nameserver == "" {
-		nameserver = "fdaa::3"
-	}
-	nameserver = net.JoinHostPort(nameserver, "53")
-
-	// We can use this DNS resolver to look up fly-based DNS
-	// records. This can be used for clustering information
-	return &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: 1 * time.Second,
-			}
-			return d.DialContext(ctx, "udp6", nameserver)
-		},
-	}
-}
@@ -0,0 +1,36 @@
+// Package privnettest serves fake Fly DNS for tests of code that uses
+// discovery.
+package privnettest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maidata/procfly/internal/privnet"
+)
+
+// Serve a peers file over DNS on the IPv6 loopback, for the test's
+// duration. It returns the server's address, to use as a nameserver, and
+// the peers file, which can be changed while it's running.
+func ServeDevDNS(t testing.TB, peers string) (addr, file string) {
+	t.Helper()
+	file = filepath.Join(t.TempDir(), "peers.yml")
+	if err := os.WriteFile(file, []byte(peers), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := privnet.ListenDevDNS("[::1]:0", file)
+	if err != nil {
+		t.Skipf("can't listen on the IPv6 loopback: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- srv.Serve() }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return srv.Addr(), file
+}
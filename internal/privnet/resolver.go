@@ -0,0 +1,106 @@
+package privnet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueryTimeout = 2 * time.Second
+	DefaultQueryRetries = 2
+)
+
+// Where the system's nameservers are listed
+const resolvConf = "/etc/resolv.conf"
+
+// How DNS queries are made
+type QueryOptions struct {
+	// How long each attempt at a query may take. Without one,
+	// attempts only end with their context.
+	Timeout time.Duration
+	// How many times a query is retried after timing out or failing,
+	// though never after the name is found not to exist
+	Retries int
+}
+
+func DefaultQueryOptions() QueryOptions {
+	return QueryOptions{Timeout: DefaultQueryTimeout, Retries: DefaultQueryRetries}
+}
+
+func (o QueryOptions) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// Whether err is from looking up a name that doesn't exist, or has no
+// records of the type asked for
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Make a query, retrying it until it succeeds, finds nothing, or ctx is done
+func query[T any](ctx context.Context, opts QueryOptions, lookup func(context.Context) (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		qctx, cancel := opts.withTimeout(ctx)
+		value, err := lookup(qctx)
+		cancel()
+		if err == nil || IsNotFound(err) || ctx.Err() != nil || attempt >= opts.Retries {
+			return value, err
+		}
+	}
+}
+
+// A resolver that sends every query to the first of the nameservers that
+// can be dialed, whether they're IPv4 or IPv6 addresses
+func nameserverResolver(opts QueryOptions, nameservers ...string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: opts.Timeout}
+			err := errors.New("no nameservers")
+			for _, nameserver := range nameservers {
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, withPort(nameserver)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// Adds the default port to a nameserver without one
+func withPort(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(nameserver, "53")
+}
+
+// The nameservers listed in a resolv.conf file, which is
+// empty if the file can't be read
+func systemNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	return nameservers
+}
@@ -0,0 +1,170 @@
+package privnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Discovery from a YAML or JSON file, which is read on every lookup so
+// that it can be edited while procfly is running. For example:
+//
+//	local_ip: 10.0.0.1
+//	apps:
+//	  nats:
+//	    peers:
+//	    - alloc_id: 2f9a13b7
+//	      region: ams
+//	      ip: 10.0.0.1
+type StaticDiscovery struct {
+	file string
+}
+
+type staticFile struct {
+	LocalIP string               `yaml:"local_ip" json:"local_ip"`
+	Apps    map[string]staticApp `yaml:"apps" json:"apps"`
+}
+
+type staticApp struct {
+	// Defaults to the peers' regions
+	Regions []string     `yaml:"regions" json:"regions"`
+	Peers   []staticPeer `yaml:"peers" json:"peers"`
+}
+
+type staticPeer struct {
+	AllocID string `yaml:"alloc_id" json:"alloc_id"`
+	Region  string `yaml:"region" json:"region"`
+	IP      string `yaml:"ip" json:"ip"`
+}
+
+func NewStaticDiscovery(file string) *StaticDiscovery {
+	return &StaticDiscovery{file: file}
+}
+
+func (s *StaticDiscovery) PeerIPs(ctx context.Context, app string) ([]net.IP, error) {
+	conf, err := s.app(app)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid ip %q for %s", s.file, peer.IP, app)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (s *StaticDiscovery) Peers(ctx context.Context, app string) ([]Peer, error) {
+	conf, err := s.app(app)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, 0, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid ip %q for %s", s.file, peer.IP, app)
+		}
+		peers = append(peers, Peer{AllocID: peer.AllocID, Region: peer.Region, IP: ip})
+	}
+	return peers, nil
+}
+
+func (s *StaticDiscovery) AllocIDs(ctx context.Context, app string) ([]string, error) {
+	conf, err := s.app(app)
+	if err != nil {
+		return nil, err
+	}
+
+	allocIDs := make([]string, 0, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		allocIDs = append(allocIDs, peer.AllocID)
+	}
+	return allocIDs, nil
+}
+
+func (s *StaticDiscovery) RegionPeers(ctx context.Context, app, region string) ([]Peer, error) {
+	return regionPeers(ctx, s, app, region)
+}
+
+func (s *StaticDiscovery) Nearest(ctx context.Context, app string, n int) ([]Peer, error) {
+	return nearestPeers(ctx, s, app, n)
+}
+
+func (s *StaticDiscovery) Regions(ctx context.Context, app string) ([]string, error) {
+	conf, err := s.app(app)
+	if err != nil {
+		return nil, err
+	}
+	return conf.regions(), nil
+}
+
+func (s *StaticDiscovery) LocalIP(ctx context.Context) (net.IP, error) {
+	conf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if conf.LocalIP == "" {
+		return net.ParseIP("127.0.0.1"), nil
+	}
+
+	ip := net.ParseIP(conf.LocalIP)
+	if ip == nil {
+		return nil, fmt.Errorf("%s: invalid local_ip %q", s.file, conf.LocalIP)
+	}
+	return ip, nil
+}
+
+// The app's regions, defaulting to its peers' regions
+func (a staticApp) regions() []string {
+	if len(a.Regions) > 0 {
+		return a.Regions
+	}
+
+	seen := make(map[string]bool)
+	regions := make([]string, 0)
+	for _, peer := range a.Peers {
+		if peer.Region != "" && !seen[peer.Region] {
+			seen[peer.Region] = true
+			regions = append(regions, peer.Region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+func (s *StaticDiscovery) app(app string) (staticApp, error) {
+	conf, err := s.load()
+	if err != nil {
+		return staticApp{}, err
+	}
+
+	found, ok := conf.Apps[app]
+	if !ok {
+		return staticApp{}, fmt.Errorf("%s: no such app %q", s.file, app)
+	}
+	return found, nil
+}
+
+func (s *StaticDiscovery) load() (*staticFile, error) {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON
+	conf := new(staticFile)
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file, err)
+	}
+	return conf, nil
+}
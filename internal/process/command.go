@@ -1,8 +1,10 @@
 package process
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 )
@@ -10,6 +12,10 @@ import (
 type Command struct {
 	Name string
 	Args []string
+	// Added to procfly's environment, as KEY=value
+	Env []string
+	// Written to the command's stdin, in place of the terminal
+	Stdin []byte
 }
 
 func (c *Command) UnmarshalText(p []byte) error {
@@ -47,6 +53,25 @@ func (c *Command) UnmarshalText(p []byte) error {
 	return nil
 }
 
+func (c Command) Equal(o Command) bool {
+	if c.Name != o.Name || !equalStrings(c.Args, o.Args) || !equalStrings(c.Env, o.Env) {
+		return false
+	}
+	return bytes.Equal(c.Stdin, o.Stdin)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (c Command) String() string {
 	return fmt.Sprintf("%s %s", c.Name, strings.Join(c.Args, " "))
 }
@@ -56,9 +81,16 @@ func (c Command) MarshalText() ([]byte, error) {
 }
 
 func (c Command) Exec() *exec.Cmd {
-	return exec.Command(c.Name, c.Args...)
+	return c.withEnv(exec.Command(c.Name, c.Args...))
 }
 
 func (c Command) ExecContext(ctx context.Context) *exec.Cmd {
-	return exec.CommandContext(ctx, c.Name, c.Args...)
+	return c.withEnv(exec.CommandContext(ctx, c.Name, c.Args...))
+}
+
+func (c Command) withEnv(cmd *exec.Cmd) *exec.Cmd {
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
 )
@@ -26,23 +27,38 @@ var colors = []lipgloss.Style{
 type MuxWriter interface {
 	Writer(string) io.Writer
 	RegisterName(string) (int, lipgloss.Style)
+	// Close all of the writer's sinks, flushing
+	// any lines they have buffered
+	Close() error
 }
 
 type muxWriterFactory struct {
 	lck    sync.Mutex
 	dst    io.Writer
+	sinks  []Sink
+	host   string
 	pfxlen int
 	clr    map[string]lipgloss.Style
 }
 
-func NewMuxWriter(dst io.Writer) MuxWriter {
+// Create a writer which multiplexes prefixed output onto dst. Each
+// line is also written, without its prefix, to all of the given sinks.
+func NewMuxWriter(dst io.Writer, sinks ...Sink) MuxWriter {
 	return &muxWriterFactory{
-		dst: dst,
-		clr: make(map[string]lipgloss.Style),
+		dst:   dst,
+		sinks: sinks,
+		host:  hostname(),
+		clr:   make(map[string]lipgloss.Style),
 	}
 }
 
 func (mwf *muxWriterFactory) RegisterName(name string) (int, lipgloss.Style) {
+	mwf.lck.Lock()
+	defer mwf.lck.Unlock()
+	return mwf.registerName(name)
+}
+
+func (mwf *muxWriterFactory) registerName(name string) (int, lipgloss.Style) {
 	if len(name) > mwf.pfxlen {
 		mwf.pfxlen = len(name)
 	}
@@ -53,7 +69,7 @@ func (mwf *muxWriterFactory) RegisterName(name string) (int, lipgloss.Style) {
 }
 
 func (mwf *muxWriterFactory) prefix(name string) []byte {
-	pfxlen, style := mwf.RegisterName(name)
+	pfxlen, style := mwf.registerName(name)
 	templ := fmt.Sprintf("%%-%ds | ", pfxlen)
 	return []byte(style.Render(fmt.Sprintf(templ, name)))
 }
@@ -61,7 +77,7 @@ func (mwf *muxWriterFactory) prefix(name string) []byte {
 func (mwf *muxWriterFactory) Writer(name string) io.Writer {
 	mwf.lck.Lock()
 	defer mwf.lck.Unlock()
-	mwf.RegisterName(name)
+	mwf.registerName(name)
 	return &muxWriter{
 		muxWriterFactory: mwf,
 		buf:              new(bytes.Buffer),
@@ -69,6 +85,40 @@ func (mwf *muxWriterFactory) Writer(name string) io.Writer {
 	}
 }
 
+func (mwf *muxWriterFactory) Close() error {
+	mwf.lck.Lock()
+	defer mwf.lck.Unlock()
+
+	var errs []error
+	for _, sink := range mwf.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	mwf.sinks = nil
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (mwf *muxWriterFactory) sink(name string, line []byte) {
+	if len(mwf.sinks) == 0 {
+		return
+	}
+
+	l := Line{
+		Time:    time.Now(),
+		Host:    mwf.host,
+		Name:    name,
+		Message: string(bytes.TrimRight(line, "\r\n")),
+	}
+	for _, sink := range mwf.sinks {
+		_ = sink.WriteLine(l)
+	}
+}
+
 type muxWriter struct {
 	*muxWriterFactory
 	buf  *bytes.Buffer
@@ -87,6 +137,7 @@ func (mw *muxWriter) Write(p []byte) (int, error) {
 	var line []byte
 	var err error
 	for line, err = rdr.ReadBytes('\n'); err == nil; line, err = rdr.ReadBytes('\n') {
+		mw.sink(mw.name, line)
 		if _, err := mw.dst.Write(append(pre, line...)); err != nil {
 			return count, err
 		}
@@ -94,6 +145,7 @@ func (mw *muxWriter) Write(p []byte) (int, error) {
 	}
 
 	if len(line) > 0 {
+		mw.sink(mw.name, line)
 		if _, err := mw.dst.Write(append(pre, append(line, '\n')...)); err != nil {
 			return count, err
 		}
@@ -0,0 +1,123 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+const (
+	// Restart the process whose output matched
+	ActionRestart = "restart"
+	// Run a command
+	ActionRun = "run"
+	// Mark the process whose output matched as unhealthy
+	ActionUnhealthy = "unhealthy"
+)
+
+type Process struct {
+	Command  Command
+	OnOutput []OutputRule
+}
+
+func (p Process) Equal(o Process) bool {
+	if !p.Command.Equal(o.Command) || len(p.OnOutput) != len(o.OnOutput) {
+		return false
+	}
+	for i, r := range p.OnOutput {
+		or := o.OnOutput[i]
+		if r.Match.String() != or.Match.String() || r.Action != or.Action || !r.Run.Equal(or.Run) {
+			return false
+		}
+	}
+	return true
+}
+
+// An OutputRule triggers an action whenever a line
+// of a process's output matches its expression.
+type OutputRule struct {
+	Match  *regexp.Regexp
+	Action string
+	// The command to run, for the run action
+	Run Command
+}
+
+func (r OutputRule) Validate() error {
+	switch r.Action {
+	case ActionRestart, ActionUnhealthy:
+		return nil
+	case ActionRun:
+		if r.Run.Name == "" {
+			return fmt.Errorf("on_output %q: missing command to run", r.Match)
+		}
+		return nil
+	default:
+		return fmt.Errorf("on_output %q: unknown action %q", r.Match, r.Action)
+	}
+}
+
+// outputWatcher splits the output of a single run of a
+// process into lines, and matches them against its rules.
+type outputWatcher struct {
+	rules    []OutputRule
+	trigger  func(OutputRule)
+	buf      bytes.Buffer
+	lck      sync.Mutex
+	inflight map[int]bool
+}
+
+func newOutputWatcher(rules []OutputRule, trigger func(OutputRule)) *outputWatcher {
+	return &outputWatcher{
+		rules:    rules,
+		trigger:  trigger,
+		inflight: make(map[int]bool),
+	}
+}
+
+func (ow *outputWatcher) Write(p []byte) (int, error) {
+	ow.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(ow.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		ow.match(bytes.TrimRight(ow.buf.Next(idx+1), "\r\n"))
+	}
+
+	// Don't let a process that never writes a newline
+	// grow the buffer without bound.
+	if ow.buf.Len() > 64*1024 {
+		ow.match(ow.buf.Next(ow.buf.Len()))
+	}
+	return len(p), nil
+}
+
+func (ow *outputWatcher) match(line []byte) {
+	for i, rule := range ow.rules {
+		if !rule.Match.Match(line) {
+			continue
+		}
+
+		// The same rule can't be triggered again until its last
+		// action has finished. A restart only ever finishes by
+		// replacing this watcher.
+		ow.lck.Lock()
+		if ow.inflight[i] {
+			ow.lck.Unlock()
+			continue
+		}
+		ow.inflight[i] = true
+		ow.lck.Unlock()
+
+		_i, _rule := i, rule
+		go func() {
+			ow.trigger(_rule)
+			if _rule.Action != ActionRestart {
+				ow.lck.Lock()
+				delete(ow.inflight, _i)
+				ow.lck.Unlock()
+			}
+		}()
+	}
+}
@@ -0,0 +1,87 @@
+package process_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/process"
+)
+
+type syncBuffer struct {
+	lck sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.lck.Lock()
+	defer sb.lck.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.lck.Lock()
+	defer sb.lck.Unlock()
+	return sb.buf.String()
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestOutputRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := new(syncBuffer)
+	sv := process.NewSupervisor(ctx, process.NewMuxWriter(out))
+
+	sv.RegisterProcess("wedged", process.Process{
+		Command: process.Command{Name: "sh", Args: []string{"-c", "echo deadlock detected; exec sleep 30"}},
+		OnOutput: []process.OutputRule{{
+			Match:  regexp.MustCompile("deadlock"),
+			Action: process.ActionUnhealthy,
+		}},
+	})
+	sv.RegisterProcess("leaky", process.Process{
+		Command: process.Command{Name: "sh", Args: []string{"-c", "echo too many open files; exec sleep 30"}},
+		OnOutput: []process.OutputRule{{
+			Match:  regexp.MustCompile("open files$"),
+			Action: process.ActionRestart,
+		}},
+	})
+
+	errs := make(chan error)
+	go func() { errs <- sv.Run() }()
+
+	eventually(t, func() bool {
+		return errors.Is(sv.Health("wedged"), process.ErrUnhealthy)
+	})
+	if err := sv.Health("leaky"); err != nil {
+		t.Error(err)
+	}
+	if unhealthy := sv.Unhealthy(); len(unhealthy) != 1 || unhealthy["wedged"] == "" {
+		t.Errorf("expected only wedged to be unhealthy, got %v", unhealthy)
+	}
+
+	eventually(t, func() bool {
+		return strings.Count(out.String(), "Start leaky") >= 2
+	})
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,421 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+var ErrUnknownSink = errors.New("unknown log sink")
+
+// A Sink receives every line written through a MuxWriter, in
+// addition to the multiplexed output written to stdout.
+type Sink interface {
+	WriteLine(Line) error
+	Close() error
+}
+
+// Sinks that buffer lines internally can implement flusher,
+// to be flushed periodically while idle.
+type flusher interface {
+	Flush() error
+}
+
+// Sinks that may block while writing can implement aborter, to give up
+// on what they're writing when they're closed without draining.
+type aborter interface {
+	abort()
+}
+
+type Line struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Name    string    `json:"process"`
+	Message string    `json:"message"`
+}
+
+type SinkConfig struct {
+	// One of syslog, json or http
+	Type string `yaml:"type"`
+	// The address to ship logs to. For syslog & json sinks, this is
+	// a URL like udp://host:514, tcp://host:514 or unix:///dev/log.
+	// Syslog's unix sockets are dialed as datagram sockets, as
+	// /dev/log usually is, falling back to stream sockets. For http
+	// sinks, it's the URL that batches are POSTed to.
+	Address string `yaml:"address"`
+	// The maximum number of lines sent in a single http request
+	BatchSize int `yaml:"batch_size"`
+	// How often partial http batches are sent
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// The number of lines that can be queued for the sink, before
+	// new lines are dropped
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// Open the configured sink. The returned sink never blocks
+// the writer: lines are queued, and dropped if the queue is full.
+func (c SinkConfig) Open() (Sink, error) {
+	var sink Sink
+	switch c.Type {
+	case "syslog", "json":
+		u, err := url.Parse(c.Address)
+		if err != nil {
+			return nil, err
+		}
+		addr := u.Host
+		if strings.HasPrefix(u.Scheme, "unix") {
+			addr = u.Path
+		}
+		if c.Type == "syslog" {
+			sink = NewSyslogSink(u.Scheme, addr)
+		} else {
+			sink = NewJSONSink(u.Scheme, addr)
+		}
+	case "http":
+		sink = NewHTTPSink(c.Address, c.BatchSize)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSink, c.Type)
+	}
+
+	interval := c.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	size := c.BufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	return newAsyncSink(sink, size, interval), nil
+}
+
+type asyncSink struct {
+	sink     Sink
+	lines    chan Line
+	dropped  int
+	interval time.Duration
+	// Closed to stop without draining the queue
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAsyncSink(sink Sink, size int, interval time.Duration) Sink {
+	as := &asyncSink{
+		sink:     sink,
+		lines:    make(chan Line, size),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go as.run()
+	return as
+}
+
+func (as *asyncSink) run() {
+	defer close(as.done)
+
+	t := time.NewTicker(as.interval)
+	defer t.Stop()
+
+	fl, _ := as.sink.(flusher)
+	for {
+		select {
+		case <-as.stop:
+			return
+		default:
+		}
+
+		select {
+		case <-as.stop:
+			return
+		case line, ok := <-as.lines:
+			if !ok {
+				if fl != nil {
+					_ = fl.Flush()
+				}
+				return
+			}
+			// Errors are dropped here; a sink that can't be written to
+			// shouldn't take down the processes whose output it's shipping.
+			_ = as.sink.WriteLine(line)
+		case <-t.C:
+			if fl != nil {
+				_ = fl.Flush()
+			}
+		}
+	}
+}
+
+// WriteLine is only called with the MuxWriter's lock held,
+// so the drop count doesn't need its own synchronization.
+func (as *asyncSink) WriteLine(line Line) error {
+	if as.dropped > 0 {
+		// Let the sink know that lines went missing, as soon as
+		// there's space in the queue again.
+		select {
+		case as.lines <- Line{
+			Time:    line.Time,
+			Host:    line.Host,
+			Name:    "procfly",
+			Message: fmt.Sprintf("Dropped %d log lines", as.dropped),
+		}:
+			as.dropped = 0
+		default:
+		}
+	}
+
+	select {
+	case as.lines <- line:
+	default:
+		as.dropped++
+	}
+	return nil
+}
+
+func (as *asyncSink) Close() error {
+	close(as.lines)
+
+	// Give the sink a little while to drain its queue. The sink
+	// is only closed once it's no longer being written to.
+	select {
+	case <-as.done:
+	case <-time.After(5 * time.Second):
+		close(as.stop)
+		if ab, ok := as.sink.(aborter); ok {
+			ab.abort()
+		}
+		<-as.done
+	}
+	return as.sink.Close()
+}
+
+// connSink writes formatted lines to a (re)dialed network connection.
+type connSink struct {
+	// Tried in order, until one can be dialed
+	networks []string
+	addr     string
+	conn     net.Conn
+	// The network that was dialed
+	network string
+	format  func(line Line, network string) []byte
+	// Cancels dialing
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConnSink(networks []string, addr string, format func(Line, string) []byte) *connSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connSink{networks: networks, addr: addr, format: format, ctx: ctx, cancel: cancel}
+}
+
+func (cs *connSink) WriteLine(line Line) error {
+	if cs.conn == nil {
+		if err := cs.dial(); err != nil {
+			return err
+		}
+	}
+
+	_ = cs.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cs.conn.Write(cs.format(line, cs.network)); err != nil {
+		// Redial on the next line
+		_ = cs.conn.Close()
+		cs.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (cs *connSink) dial() error {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	var err error
+	for _, network := range cs.networks {
+		var conn net.Conn
+		if conn, err = d.DialContext(cs.ctx, network, cs.addr); err == nil {
+			cs.conn, cs.network = conn, network
+			return nil
+		}
+	}
+	return err
+}
+
+func (cs *connSink) abort() {
+	cs.cancel()
+}
+
+func (cs *connSink) Close() error {
+	cs.cancel()
+	if cs.conn == nil {
+		return nil
+	}
+	return cs.conn.Close()
+}
+
+// Create a sink that writes RFC5424 syslog messages. Stream networks (tcp, unix)
+// use octet-counted framing (RFC6587), datagram networks send a message per packet.
+// A unix socket is dialed as a datagram socket first, as /dev/log usually is.
+func NewSyslogSink(network, addr string) Sink {
+	networks := []string{network}
+	if network == "unix" {
+		networks = []string{"unixgram", "unix"}
+	}
+	return newConnSink(networks, addr, func(line Line, network string) []byte {
+		msg := FormatSyslog(line)
+		switch network {
+		case "tcp", "tcp4", "tcp6", "unix":
+			return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+		return msg
+	})
+}
+
+// Format the line as an RFC5424 message, with the daemon facility
+// and informational severity.
+func FormatSyslog(line Line) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s - - - %s",
+		3*8+6,
+		line.Time.UTC().Format(time.RFC3339Nano),
+		syslogField(line.Host, 255),
+		syslogField(line.Name, 48),
+		line.Message,
+	))
+}
+
+func syslogField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+
+	if value == "" {
+		return "-"
+	} else if len(value) > max {
+		return value[:max]
+	}
+	return value
+}
+
+// Create a sink that writes newline-delimited JSON objects.
+func NewJSONSink(network, addr string) Sink {
+	return newConnSink([]string{network}, addr, func(line Line, _ string) []byte {
+		p, _ := json.Marshal(line)
+		return append(p, '\n')
+	})
+}
+
+type httpSink struct {
+	url    string
+	size   int
+	lck    sync.Mutex
+	batch  []Line
+	client *http.Client
+	// Cancels requests & their retries
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Create a sink that POSTs batches of newline-delimited JSON lines
+// to the given URL, retrying failed requests with a backoff.
+func NewHTTPSink(url string, batchSize int) Sink {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &httpSink{
+		url:    url,
+		size:   batchSize,
+		client: &http.Client{Timeout: 10 * time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (hs *httpSink) WriteLine(line Line) error {
+	hs.lck.Lock()
+	hs.batch = append(hs.batch, line)
+	full := len(hs.batch) >= hs.size
+	hs.lck.Unlock()
+
+	if full {
+		return hs.Flush()
+	}
+	return nil
+}
+
+func (hs *httpSink) Flush() error {
+	hs.lck.Lock()
+	batch := hs.batch
+	hs.batch = nil
+	hs.lck.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	for _, line := range batch {
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	boff := backoff.NewExponentialBackOff()
+	boff.MaxElapsedTime = 30 * time.Second
+	return backoff.Retry(func() error {
+		return hs.post(body.Bytes())
+	}, backoff.WithContext(boff, hs.ctx))
+}
+
+func (hs *httpSink) post(body []byte) error {
+	req, err := http.NewRequestWithContext(hs.ctx, "POST", hs.url, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%s: %s", hs.url, resp.Status)
+	default:
+		// Retrying won't help a request that was rejected
+		return backoff.Permanent(fmt.Errorf("%s: %s", hs.url, resp.Status))
+	}
+}
+
+func (hs *httpSink) abort() {
+	hs.cancel()
+}
+
+func (hs *httpSink) Close() error {
+	defer hs.cancel()
+	return hs.Flush()
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,201 @@
+package process_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/process"
+)
+
+func TestFormatSyslog(t *testing.T) {
+	line := process.Line{
+		Time:    time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Host:    "my host",
+		Name:    "nats",
+		Message: "hello world",
+	}
+
+	expected := "<30>1 2023-01-02T03:04:05Z my_host nats - - - hello world"
+	if actual := string(process.FormatSyslog(line)); actual != expected {
+		t.Errorf("%q != %q", actual, expected)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	sink, err := process.SinkConfig{
+		Type:    "json",
+		Address: "tcp://" + lis.Addr().String(),
+	}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := process.NewMuxWriter(io.Discard, sink)
+	fmt.Fprint(mux.Writer("nats"), "abc\ndef\n")
+	defer mux.Close()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	scn := bufio.NewScanner(conn)
+	for _, expected := range []string{"abc", "def"} {
+		if !scn.Scan() {
+			t.Fatal(scn.Err())
+		}
+		var line process.Line
+		if err := json.Unmarshal(scn.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Name != "nats" || line.Message != expected {
+			t.Errorf("unexpected line: %+v", line)
+		}
+	}
+}
+
+func TestHTTPSinkBatches(t *testing.T) {
+	var lck sync.Mutex
+	var batches []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		scn := bufio.NewScanner(r.Body)
+		for scn.Scan() {
+			count++
+		}
+		lck.Lock()
+		batches = append(batches, count)
+		lck.Unlock()
+	}))
+	defer srv.Close()
+
+	sink, err := process.SinkConfig{
+		Type:          "http",
+		Address:       srv.URL,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := process.NewMuxWriter(io.Discard, sink)
+	fmt.Fprint(mux.Writer("nats"), "a\nb\nc\n")
+	if err := mux.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+	if fmt.Sprint(batches) != "[2 1]" {
+		t.Errorf("unexpected batches: %v", batches)
+	}
+}
+
+func TestUnreachableSinkDoesNotBlock(t *testing.T) {
+	// Nothing is accepting connections here, and the queue is tiny,
+	// so almost every line will be dropped.
+	sink, err := process.SinkConfig{
+		Type:       "syslog",
+		Address:    "tcp://127.0.0.1:1",
+		BufferSize: 1,
+	}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := process.NewMuxWriter(io.Discard, sink)
+	defer mux.Close()
+
+	done := make(chan struct{})
+	go func() {
+		w := mux.Writer("nats")
+		for i := 0; i < 10000; i++ {
+			fmt.Fprintln(w, "line", i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on an unreachable sink")
+	}
+}
+
+func TestSyslogSinkUnixgram(t *testing.T) {
+	// Like /dev/log, a datagram socket
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("can't listen on a unix datagram socket: %v", err)
+	}
+	defer conn.Close()
+
+	sink, err := process.SinkConfig{Type: "syslog", Address: "unix://" + path}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := process.NewMuxWriter(io.Discard, sink)
+	defer mux.Close()
+	fmt.Fprintln(mux.Writer("nats"), "hello")
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Datagrams aren't framed
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<30>1 ") || !strings.HasSuffix(msg, " nats - - - hello") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+func TestSinkCloseAborts(t *testing.T) {
+	// A server that never answers, which the sink keeps retrying
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sink, err := process.SinkConfig{Type: "http", Address: srv.URL, BatchSize: 1}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := process.NewMuxWriter(io.Discard, sink)
+	fmt.Fprintln(mux.Writer("nats"), "hello")
+
+	closed := make(chan struct{})
+	go func() {
+		mux.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(9 * time.Second):
+		t.Fatal("closing blocked on an unresponsive sink")
+	}
+}
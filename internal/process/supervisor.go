@@ -1,6 +1,7 @@
 package process
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,46 +23,148 @@ var (
 	ErrNotRunning      = errors.New("supervisor is not running")
 	ErrExitedWithCode  = errors.New("exited with error code")
 	ErrExitedWithError = errors.New("exited with error")
+	ErrRestarted       = errors.New("restarted")
+	ErrUnknownProcess  = errors.New("unknown process")
+	ErrUnhealthy       = errors.New("unhealthy")
 )
 
+// An action to take when a templated file changes
 type OnChange struct {
+	// Run a command
 	Run Command `yaml:"run"`
+	// Run the named reload command
+	Reload string `yaml:"reload"`
+	// Restart the named process
+	Restart string `yaml:"restart"`
+	// Send the signal to the named process
+	Signal  string `yaml:"signal"`
+	Process string `yaml:"process"`
+}
+
+func (oc OnChange) Validate() error {
+	var count int
+	for _, set := range []bool{oc.Run.Name != "", oc.Reload != "", oc.Restart != "", oc.Signal != ""} {
+		if set {
+			count++
+		}
+	}
+
+	switch {
+	case count != 1:
+		return errors.New("on_change: expected exactly one of run, reload, restart or signal")
+	case oc.Signal != "" && oc.Process == "":
+		return errors.New("on_change: missing process to signal")
+	case oc.Signal != "":
+		_, err := ParseSignal(oc.Signal)
+		return err
+	default:
+		return nil
+	}
+}
+
+func (oc OnChange) String() string {
+	switch {
+	case oc.Reload != "":
+		return "reload " + oc.Reload
+	case oc.Restart != "":
+		return "restart " + oc.Restart
+	case oc.Signal != "":
+		return fmt.Sprintf("signal %s %s", oc.Signal, oc.Process)
+	default:
+		return "run " + oc.Run.String()
+	}
 }
 
 type Supervisor interface {
+	// Register commands with the supervisor. Commands can be registered
+	// while the supervisor is running: a new init is run immediately,
+	// a new process is started, and a process whose command or spec has
+	// changed is restarted.
 	RegisterInit(string, Command)
-	RegisterProcess(string, Command)
+	RegisterProcess(string, Process)
 	RegisterReload(string, Command)
+	// Remove commands from the supervisor. Removed processes are
+	// stopped, if the supervisor is running.
+	RemoveInit(string)
+	RemoveProcess(string)
+	RemoveReload(string)
 	// Run all of the supervisor's registered
 	// commands
 	Run() error
-	// Run all of the supervisor's registered
-	// reload scripts
-	Reload() error
+	// Run the named reload scripts, or all of the
+	// supervisor's registered reload scripts if
+	// none are named
+	Reload(names ...string) error
+	// Send a signal to the named process
+	Signal(name string, sig os.Signal) error
+	// Take the given action
+	Trigger(OnChange) error
+	// Gracefully stop the named process, and
+	// start it again
+	Restart(name string) error
+	// Returns an error if the named process has
+	// been marked as unhealthy
+	Health(name string) error
+	// The processes that have been marked as
+	// unhealthy, with the reason for each
+	Unhealthy() map[string]string
 	// Log a message with the given prefix, using
 	// the supervisor's multiplexed (prefixed) writer
 	Log(name, message string)
 	Logf(name, message string, args ...any)
+	// Filter every message logged by the supervisor, such
+	// as to hide secrets in the commands that it starts
+	SetRedact(redact func(string) string)
 }
 
 type supervisor struct {
 	root  context.Context
 	sout  MuxWriter
 	lock  sync.Mutex
-	ctxs  map[string]context.Context
 	inits map[string]Command
-	cmds  map[string]Command
+	cmds  map[string]Process
 	rlds  map[string]Command
+
+	// Guards the registered commands, and the
+	// state of running processes
+	mu      sync.Mutex
+	procs   map[string]*procHandle
+	running map[string]*instance
+	health  map[string]string
+
+	// Set while processes are running
+	pctx context.Context
+	perr chan error
+	pwg  sync.WaitGroup
+
+	// A func(string) string, applied to log messages
+	redact atomic.Value
+}
+
+// A process's restart loop
+type procHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func NewSupervisor(ctx context.Context) Supervisor {
+// A single run of a command
+type instance struct {
+	cancel  context.CancelFunc
+	restart bool
+	proc    *os.Process
+}
+
+func NewSupervisor(ctx context.Context, sout MuxWriter) Supervisor {
 	return &supervisor{
 		root:  ctx,
-		sout:  NewMuxWriter(os.Stdout),
-		ctxs:  make(map[string]context.Context),
+		sout:  sout,
 		inits: make(map[string]Command),
-		cmds:  make(map[string]Command),
+		cmds:  make(map[string]Process),
 		rlds:  make(map[string]Command),
+
+		procs:   make(map[string]*procHandle),
+		running: make(map[string]*instance),
+		health:  make(map[string]string),
 	}
 }
 
@@ -69,15 +173,50 @@ func (sv *supervisor) RegisterInit(name string, cmd Command) {
 	// chances of the log prefix being resized during
 	// execution of the processes.
 	sv.sout.RegisterName("init_" + name)
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if old, ok := sv.inits[name]; ok && old.Equal(cmd) {
+		return
+	}
 	sv.inits[name] = cmd
+
+	if sv.pctx != nil {
+		// Processes are already running, so the init
+		// has missed its chance to run before them.
+		go func() {
+			ctx, cancel := context.WithTimeout(sv.root, 10*time.Second)
+			defer cancel()
+			if err := sv.run(ctx, "init_"+name, cmd)(); err != nil {
+				sv.Logf("procfly", "Init %s failed: %s", name, err)
+			}
+		}()
+	}
 }
 
-func (sv *supervisor) RegisterProcess(name string, cmd Command) {
+func (sv *supervisor) RegisterProcess(name string, proc Process) {
 	// We can pre-register known names to reduce the
 	// chances of the log prefix being resized during
 	// execution of the processes.
 	sv.sout.RegisterName(name)
-	sv.cmds[name] = cmd
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	old, ok := sv.cmds[name]
+	sv.cmds[name] = proc
+
+	switch {
+	case sv.pctx == nil:
+		// Not running yet; it'll be started with everything else
+	case ok && old.Equal(proc):
+		// Unchanged, so leave it be
+	case !sv.looping(name):
+		sv.startProcess(name)
+	default:
+		// The restart loop will pick up the new command
+		// when the running one has stopped.
+		_ = sv.restartLocked(name)
+	}
 }
 
 func (sv *supervisor) RegisterReload(name string, cmd Command) {
@@ -85,9 +224,38 @@ func (sv *supervisor) RegisterReload(name string, cmd Command) {
 	// chances of the log prefix being resized during
 	// execution of the processes.
 	sv.sout.RegisterName("reload_" + name)
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
 	sv.rlds[name] = cmd
 }
 
+func (sv *supervisor) RemoveInit(name string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	delete(sv.inits, name)
+}
+
+func (sv *supervisor) RemoveProcess(name string) {
+	sv.mu.Lock()
+	delete(sv.cmds, name)
+	h, ok := sv.procs[name]
+	delete(sv.procs, name)
+	sv.mu.Unlock()
+
+	if ok {
+		sv.Logf("procfly", "Stopping %s", name)
+		h.cancel()
+		<-h.done
+	}
+}
+
+func (sv *supervisor) RemoveReload(name string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	delete(sv.rlds, name)
+}
+
 func (sv *supervisor) Run() error {
 	if !sv.lock.TryLock() {
 		// If we can't acquire the lock, that means
@@ -114,10 +282,12 @@ func (sv *supervisor) runInits() error {
 	defer cancel()
 
 	egrp, gctx := errgroup.WithContext(ctx)
+	sv.mu.Lock()
 	for name, cmd := range sv.inits {
 		_cmd, _name := cmd, name
 		egrp.Go(sv.run(gctx, "init_"+_name, _cmd))
 	}
+	sv.mu.Unlock()
 	return egrp.Wait()
 }
 
@@ -125,27 +295,103 @@ func (sv *supervisor) runProcesses() error {
 	ctx, cancel := context.WithCancel(sv.root)
 	defer cancel()
 
-	egrp, gctx := errgroup.WithContext(ctx)
-	for name, cmd := range sv.cmds {
-		_cmd, _name := cmd, name
-		egrp.Go(sv.withRestarts(gctx, _name, sv.run(gctx, _name, _cmd)))
+	sv.mu.Lock()
+	sv.pctx, sv.perr = ctx, make(chan error, 1)
+	for name := range sv.cmds {
+		sv.startProcess(name)
 	}
+	sv.mu.Unlock()
+
+	// Like an errgroup, the first process to fail
+	// stops all of the others. Processes can come
+	// and go, so we can't use an errgroup here.
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-sv.perr:
+		cancel()
+	}
+	sv.pwg.Wait()
+
+	sv.mu.Lock()
+	sv.pctx, sv.perr = nil, nil
+	sv.procs = make(map[string]*procHandle)
+	sv.mu.Unlock()
 
-	if err := egrp.Wait(); !errors.Is(err, context.Canceled) {
+	if err != nil && !errors.Is(err, context.Canceled) {
 		return err
 	}
 	return nil
 }
 
-func (sv *supervisor) setupStdout(name string, cmd *exec.Cmd) error {
+// Start the named process's restart loop. Must be called with sv.mu held.
+func (sv *supervisor) startProcess(name string) {
+	ctx, cancel := context.WithCancel(sv.pctx)
+	h := &procHandle{cancel: cancel, done: make(chan struct{})}
+	sv.procs[name] = h
+	perr := sv.perr
+
+	sv.pwg.Add(1)
+	go func() {
+		defer sv.pwg.Done()
+		defer close(h.done)
+		defer cancel()
+
+		err := sv.withRestarts(ctx, name, func() error {
+			// Look up the process on each run, since it
+			// may have been changed since the last one.
+			sv.mu.Lock()
+			proc, ok := sv.cmds[name]
+			sv.mu.Unlock()
+			if !ok {
+				return nil
+			}
+			return sv.run(ctx, name, proc.Command, proc.OnOutput...)()
+		})()
+
+		if err != nil && !errors.Is(err, context.Canceled) {
+			select {
+			case perr <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// Returns true if the named process's restart loop is still
+// going. Must be called with sv.mu held.
+func (sv *supervisor) looping(name string) bool {
+	h, ok := sv.procs[name]
+	if !ok {
+		return false
+	}
+	select {
+	case <-h.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (sv *supervisor) setupStdout(name string, cmd *exec.Cmd, rules []OutputRule) (*os.File, error) {
 	pseu, term, err := pty.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// We need to copy output from the pseudo-terminal
-	// over to stdout
-	go io.Copy(sv.sout.Writer(name), pseu)
+	// over to stdout, and to anything watching for
+	// patterns in the output.
+	var w io.Writer = sv.sout.Writer(name)
+	if len(rules) > 0 {
+		w = io.MultiWriter(w, newOutputWatcher(rules, func(rule OutputRule) {
+			sv.onOutput(name, rule)
+		}))
+	}
+	go func() {
+		_, _ = io.Copy(w, pseu)
+		pseu.Close()
+	}()
 
 	// Set file descriptors on process
 	cmd.Stdout = term
@@ -156,7 +402,7 @@ func (sv *supervisor) setupStdout(name string, cmd *exec.Cmd) error {
 		Setctty: true,
 	}
 
-	return nil
+	return term, nil
 }
 
 func (sv *supervisor) withRestarts(ctx context.Context, name string, fn func() error) func() error {
@@ -167,7 +413,11 @@ func (sv *supervisor) withRestarts(ctx context.Context, name string, fn func() e
 
 	return func() error {
 		for {
-			if err := fn(); errors.Is(err, ErrExitedWithCode) || errors.Is(err, ErrExitedWithError) {
+			if err := fn(); errors.Is(err, ErrRestarted) {
+				sv.Logf("procfly", "Restarting %s", name)
+				boff.Reset()
+				continue
+			} else if errors.Is(err, ErrExitedWithCode) || errors.Is(err, ErrExitedWithError) {
 				nboff := boff.NextBackOff()
 				sv.Logf(name, err.Error())
 				sv.Logf("procfly", "Waiting %s before restarting %s", nboff, name)
@@ -184,19 +434,40 @@ func (sv *supervisor) withRestarts(ctx context.Context, name string, fn func() e
 	}
 }
 
-func (sv *supervisor) run(ctx context.Context, name string, command Command) func() error {
+func (sv *supervisor) run(ctx context.Context, name string, command Command, rules ...OutputRule) func() error {
 	return func() error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		inst := sv.track(name, cancel)
+		defer sv.untrack(name, inst)
+
 		sv.Logf("procfly", "Start %s: %s", name, command)
 		cmd := command.Exec()
 
-		if err := sv.setupStdout(name, cmd); err != nil {
+		term, err := sv.setupStdout(name, cmd, rules)
+		if err != nil {
 			return err
 		}
+		if command.Stdin != nil {
+			// The terminal is still the controlling
+			// one, through stdout.
+			cmd.Stdin = bytes.NewReader(command.Stdin)
+			cmd.SysProcAttr.Ctty = 1
+		}
 
-		if err := cmd.Start(); err != nil {
+		err = cmd.Start()
+		// The child has its own copy of the terminal now. Closing
+		// ours lets the output copy finish once the child exits.
+		term.Close()
+		if err != nil {
 			return err
 		}
 
+		sv.mu.Lock()
+		inst.proc = cmd.Process
+		sv.mu.Unlock()
+
 		sch := make(chan *os.ProcessState)
 
 		go func() {
@@ -239,30 +510,173 @@ func (sv *supervisor) run(ctx context.Context, name string, command Command) fun
 			// should ignore the error message from killing, and
 			// return the one from the context that caused it.
 			_ = cmd.Process.Kill()
+			if sv.restarting(inst) {
+				return fmt.Errorf("%s: %w", name, ErrRestarted)
+			}
 			return ctx.Err()
 		case <-sch:
 			// Sending the signal managed to shut down the process
-			// gracefully. We can exit without an error.
+			// gracefully. We can exit without an error, unless it
+			// was stopped so that it could be restarted.
+			if sv.restarting(inst) {
+				return fmt.Errorf("%s: %w", name, ErrRestarted)
+			}
 			return nil
 		}
 	}
 }
 
-func (sv *supervisor) Reload() error {
+func (sv *supervisor) track(name string, cancel context.CancelFunc) *instance {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	inst := &instance{cancel: cancel}
+	sv.running[name] = inst
+	// A fresh run of a process starts out healthy
+	delete(sv.health, name)
+	return inst
+}
+
+func (sv *supervisor) untrack(name string, inst *instance) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.running[name] == inst {
+		delete(sv.running, name)
+	}
+}
+
+func (sv *supervisor) restarting(inst *instance) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return inst.restart
+}
+
+func (sv *supervisor) Restart(name string) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if _, ok := sv.cmds[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProcess, name)
+	}
+	return sv.restartLocked(name)
+}
+
+func (sv *supervisor) restartLocked(name string) error {
+	inst, ok := sv.running[name]
+	if !ok {
+		return ErrNotRunning
+	}
+	inst.restart = true
+	inst.cancel()
+	return nil
+}
+
+func (sv *supervisor) Signal(name string, sig os.Signal) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if _, ok := sv.cmds[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProcess, name)
+	}
+
+	inst, ok := sv.running[name]
+	if !ok || inst.proc == nil {
+		return ErrNotRunning
+	}
+	return inst.proc.Signal(sig)
+}
+
+func (sv *supervisor) Trigger(action OnChange) error {
+	if err := action.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case action.Reload != "":
+		return sv.Reload(action.Reload)
+	case action.Restart != "":
+		return sv.Restart(action.Restart)
+	case action.Signal != "":
+		sig, _ := ParseSignal(action.Signal)
+		return sv.Signal(action.Process, sig)
+	default:
+		ctx, cancel := context.WithTimeout(sv.root, 30*time.Second)
+		defer cancel()
+		return sv.run(ctx, "on_change", action.Run)()
+	}
+}
+
+func (sv *supervisor) Health(name string) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if reason, ok := sv.health[name]; ok {
+		return fmt.Errorf("%s: %w: %s", name, ErrUnhealthy, reason)
+	}
+	return nil
+}
+
+func (sv *supervisor) Unhealthy() map[string]string {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	unhealthy := make(map[string]string, len(sv.health))
+	for name, reason := range sv.health {
+		unhealthy[name] = reason
+	}
+	return unhealthy
+}
+
+func (sv *supervisor) onOutput(name string, rule OutputRule) {
+	switch rule.Action {
+	case ActionRestart:
+		sv.Logf("procfly", "Output of %s matched %q, restarting", name, rule.Match)
+		if err := sv.Restart(name); err != nil {
+			sv.Logf("procfly", "Unable to restart %s: %s", name, err)
+		}
+	case ActionRun:
+		sv.Logf("procfly", "Output of %s matched %q, running %s", name, rule.Match, rule.Run)
+		ctx, cancel := context.WithTimeout(sv.root, 30*time.Second)
+		defer cancel()
+		if err := sv.run(ctx, "action_"+name, rule.Run)(); err != nil {
+			sv.Logf("procfly", "Action for %s failed: %s", name, err)
+		}
+	case ActionUnhealthy:
+		sv.mu.Lock()
+		_, already := sv.health[name]
+		sv.health[name] = fmt.Sprintf("output matched %q", rule.Match)
+		sv.mu.Unlock()
+		if !already {
+			sv.Logf("procfly", "Output of %s matched %q, marking unhealthy", name, rule.Match)
+		}
+	}
+}
+
+func (sv *supervisor) Reload(names ...string) error {
 	if sv.lock.TryLock() {
 		defer sv.lock.Unlock()
 		return ErrNotRunning
 	}
 
+	sv.mu.Lock()
+	rlds := sv.rlds
+	if len(names) > 0 {
+		rlds = make(map[string]Command, len(names))
+		for _, name := range names {
+			cmd, ok := sv.rlds[name]
+			if !ok {
+				sv.mu.Unlock()
+				return fmt.Errorf("unknown reload command: %s", name)
+			}
+			rlds[name] = cmd
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(sv.root, 5*time.Second)
 	defer cancel()
 
 	egrp, gctx := errgroup.WithContext(ctx)
 
-	for name, cmd := range sv.rlds {
+	for name, cmd := range rlds {
 		_cmd, _name := cmd, name
 		egrp.Go(sv.run(gctx, "reload_"+_name, _cmd))
 	}
+	sv.mu.Unlock()
 
 	err := egrp.Wait()
 	if errors.Is(err, context.Canceled) {
@@ -274,9 +688,16 @@ func (sv *supervisor) Reload() error {
 }
 
 func (sv *supervisor) Log(name, message string) {
+	if redact, ok := sv.redact.Load().(func(string) string); ok {
+		message = redact(message)
+	}
 	fmt.Fprintln(sv.sout.Writer(name), message)
 }
 
 func (sv *supervisor) Logf(name, message string, args ...any) {
-	fmt.Fprintf(sv.sout.Writer(name), message, args...)
+	sv.Log(name, fmt.Sprintf(message, args...))
+}
+
+func (sv *supervisor) SetRedact(redact func(string) string) {
+	sv.redact.Store(redact)
 }
@@ -0,0 +1,83 @@
+package process_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/maidata/procfly/internal/process"
+)
+
+func sleeper(arg string) process.Process {
+	return process.Process{
+		Command: process.Command{Name: "sleep", Args: []string{arg}},
+	}
+}
+
+func TestRegisterWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := new(syncBuffer)
+	sv := process.NewSupervisor(ctx, process.NewMuxWriter(out))
+	sv.RegisterProcess("a", sleeper("30"))
+	sv.RegisterProcess("b", sleeper("31"))
+
+	errs := make(chan error)
+	go func() { errs <- sv.Run() }()
+
+	eventually(t, func() bool {
+		return strings.Contains(out.String(), "Start a") && strings.Contains(out.String(), "Start b")
+	})
+
+	// Unchanged processes are left alone, changed ones
+	// are restarted, and new ones are started.
+	sv.RegisterProcess("a", sleeper("30"))
+	sv.RegisterProcess("b", sleeper("32"))
+	sv.RegisterProcess("c", sleeper("33"))
+	sv.RemoveProcess("a")
+
+	eventually(t, func() bool {
+		return strings.Contains(out.String(), "Start b: sleep 32") && strings.Contains(out.String(), "Start c")
+	})
+	if count := strings.Count(out.String(), "Start a"); count != 1 {
+		t.Errorf("a was started %d times", count)
+	}
+	if !strings.Contains(out.String(), "Stopping a") {
+		t.Error("a wasn't stopped")
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedactedLogs(t *testing.T) {
+	out := new(syncBuffer)
+	sv := process.NewSupervisor(context.Background(), process.NewMuxWriter(out))
+	sv.SetRedact(strings.NewReplacer("hunter22", "[redacted]").Replace)
+
+	sv.Logf("procfly", "Start %s: %s", "nats", "nats-server --pass hunter22")
+	if got := out.String(); strings.Contains(got, "hunter22") || !strings.Contains(got, "--pass [redacted]") {
+		t.Errorf("secret wasn't redacted: %q", got)
+	}
+}
+
+func TestTriggerEnvAndStdin(t *testing.T) {
+	out := new(syncBuffer)
+	sv := process.NewSupervisor(context.Background(), process.NewMuxWriter(out))
+
+	err := sv.Trigger(process.OnChange{Run: process.Command{
+		Name:  "sh",
+		Args:  []string{"-c", "echo $GREETING; cat"},
+		Env:   []string{"GREETING=hello"},
+		Stdin: []byte("from stdin\n"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		return strings.Contains(out.String(), "hello") && strings.Contains(out.String(), "from stdin")
+	})
+}
@@ -0,0 +1,69 @@
+package render
+
+import (
+	"container/list"
+	"sync"
+	"text/template"
+)
+
+// The number of parsed templates kept by each renderer
+const cacheSize = 256
+
+// A least-recently-used cache of parsed templates, safe for concurrent use.
+// Parsed templates are only ever executed once they're in the cache, which
+// text/template allows to happen concurrently.
+type templateCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	tmpl *template.Template
+}
+
+func newTemplateCache(size int) *templateCache {
+	return &templateCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *templateCache) get(key string) (*template.Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).tmpl, true
+}
+
+func (c *templateCache) put(key string, tmpl *template.Template) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*cacheEntry).tmpl = tmpl
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, tmpl: tmpl})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *templateCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,33 @@
+package render
+
+import (
+	"fmt"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateCache(t *testing.T) {
+	cache := newTemplateCache(2)
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprint(i)
+		cache.put(key, template.New(key))
+		if i == 1 {
+			// Using the oldest template keeps it around
+			if _, ok := cache.get("0"); !ok {
+				t.Fatal("expected 0 to be cached")
+			}
+		}
+	}
+
+	if cache.len() != 2 {
+		t.Errorf("expected 2 cached templates, got %d", cache.len())
+	}
+	if _, ok := cache.get("1"); ok {
+		t.Error("expected 1 to have been evicted")
+	}
+	for _, key := range []string{"0", "2"} {
+		if tmpl, ok := cache.get(key); !ok || tmpl.Name() != key {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
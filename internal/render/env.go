@@ -2,8 +2,10 @@ package render
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/maidata/procfly/internal/file"
@@ -14,10 +16,16 @@ type Vars struct {
 	Env     EnvVars
 	Fly     FlyVars
 	Procfly ProcflyVars
+	// Loaded separately, with a Platform
+	Platform PlatformVars
+	// Loaded separately, with LoadSecrets
+	Secrets SecretVars
 }
 
-func LoadVars(paths file.Paths) (env Vars, err error) {
-	env.Fly, err = loadFlyEnv()
+// Load the variables, discovering the app's peers with disc. If app is
+// empty, the instance is running alone, and nothing is discovered.
+func LoadVars(paths file.Paths, disc privnet.Discovery, app string) (env Vars, err error) {
+	env.Fly, err = loadFlyEnv(disc, app)
 	if err != nil {
 		return
 	}
@@ -34,6 +42,8 @@ func LoadVars(paths file.Paths) (env Vars, err error) {
 type ProcflyVars struct {
 	Root string
 	File string
+	// Whether this instance leads the app, which is set by procfly run
+	IsLeader bool
 }
 
 type EnvVars map[string]string
@@ -57,6 +67,8 @@ type FlyVars struct {
 	AppName string
 	// The region that this instance is deployed in
 	Region string
+	// The app's primary region, which defaults to Region
+	PrimaryRegion string
 	// All regions that this app is deployed in
 	AllRegions []string
 	// The IP address for this instance
@@ -66,47 +78,108 @@ type FlyVars struct {
 	ServerName   string
 	AllocID      string
 	PeerAllocIDs []string
+	// Every instance of the app, including this one
+	Peers []FlyPeer
+	// The peer IPs that have appeared or disappeared since the peers
+	// last settled, when on_peers_change was last run. Both are empty
+	// until the peers first change.
+	PeersAdded   []string
+	PeersRemoved []string
+	// The machine's ID, which defaults to ServerName
+	MachineID string
+	// The machine's docker image
+	ImageRef string
+	// The machine's public IPv6 address, and its 6PN
+	// address, which defaults to IP
+	PublicIP  string
+	PrivateIP string
+	// The machine's process group, from fly.toml. Defaults to app.
+	ProcessGroup string
+	// The machine's memory, or 0 if it isn't known
+	VMMemoryMB int
 }
 
-func loadFlyEnv() (env FlyVars, err error) {
-	env.ServerName = os.Getenv("FLY_ALLOC_ID")
-	if env.ServerName == "" {
-		env.ServerName = "local-id"
-	}
+// An instance of the app
+type FlyPeer struct {
+	// The 8 character prefix of its allocation ID
+	AllocID string
+	// Empty if the discovery doesn't know it
+	Region string
+	IP     string
+	// Its hostname in Fly's VM DNS, {alloc}.vm.{app}.internal
+	Host string
+}
 
-	env.Region = os.Getenv("FLY_REGION")
-	if env.Region == "" {
-		env.Region = "local"
-	}
+// Set the peers added & removed since the settled peers
+func (f *FlyVars) DiffPeers(settled []string) {
+	f.PeersAdded, f.PeersRemoved = DiffPeers(settled, f.PeerIPs)
+}
 
-	env.AllocID = env.ServerName[:8]
-	if env.AllocID == "" {
-		env.AllocID = "local-id"
+// The peers that are in next but not prev, and those in prev but not next
+func DiffPeers(prev, next []string) (added, removed []string) {
+	in := func(peers []string, peer string) bool {
+		for _, p := range peers {
+			if p == peer {
+				return true
+			}
+		}
+		return false
+	}
+	for _, peer := range next {
+		if !in(prev, peer) {
+			added = append(added, peer)
+		}
 	}
+	for _, peer := range prev {
+		if !in(next, peer) {
+			removed = append(removed, peer)
+		}
+	}
+	return added, removed
+}
 
-	env.AppName = os.Getenv("FLY_APP_NAME")
+func loadFlyEnv(disc privnet.Discovery, app string) (env FlyVars, err error) {
+	env.ServerName = getenv("FLY_ALLOC_ID", "local-id")
+	env.AllocID = privnet.ShortAllocID(env.ServerName)
+	env.Region = getenv("FLY_REGION", "local")
+	env.PrimaryRegion = getenv("PRIMARY_REGION", env.Region)
+	env.MachineID = getenv("FLY_MACHINE_ID", env.ServerName)
+	env.ImageRef = os.Getenv("FLY_IMAGE_REF")
+	env.PublicIP = os.Getenv("FLY_PUBLIC_IP")
+	env.PrivateIP = os.Getenv("FLY_PRIVATE_IP")
+	env.ProcessGroup = getenv("FLY_PROCESS_GROUP", "app")
+	env.VMMemoryMB, _ = strconv.Atoi(os.Getenv("FLY_VM_MEMORY_MB"))
+
+	env.AppName = app
 	if env.AppName == "" {
 		env.Host = "localhost"
 		env.AppName = "local"
 		env.AllRegions = []string{"local"}
+		env.Peers = []FlyPeer{{AllocID: env.AllocID, Region: env.Region, Host: env.Host}}
 		return
 	}
 
-	env.Host = "fly-local-6pn"
-	if env.AllRegions, err = privnet.GetRegions(
+	env.Host = "localhost"
+	if os.Getenv("FLY_APP_NAME") != "" {
+		env.Host = "fly-local-6pn"
+	}
+	if env.AllRegions, err = disc.Regions(
 		context.Background(),
 		env.AppName,
 	); err != nil {
 		return
 	}
 
-	if ip, err := privnet.PrivateIPv6(); err != nil {
+	if ip, err := disc.LocalIP(context.Background()); err != nil {
 		return env, err
 	} else {
 		env.IP = ip.String()
 	}
+	if env.PrivateIP == "" {
+		env.PrivateIP = env.IP
+	}
 
-	if ips, err := privnet.AllPeerIPs(
+	if ips, err := disc.PeerIPs(
 		context.Background(),
 		env.AppName,
 	); err != nil {
@@ -118,7 +191,7 @@ func loadFlyEnv() (env FlyVars, err error) {
 		}
 	}
 
-	if allocIDs, err := privnet.AllPeerAllocIDs(
+	if allocIDs, err := disc.AllocIDs(
 		context.Background(),
 		env.AppName,
 	); err != nil {
@@ -138,7 +211,62 @@ func loadFlyEnv() (env FlyVars, err error) {
 		}
 	}
 
+	if peers, err := disc.Peers(
+		context.Background(),
+		env.AppName,
+	); err != nil {
+		return env, err
+	} else {
+		env.Peers = flyPeers(peers, env)
+	}
+
 	// easier to compare
 	sort.Strings(env.AllRegions)
 	return
 }
+
+// The peers, including this instance if it hasn't been discovered yet
+func flyPeers(peers []privnet.Peer, env FlyVars) []FlyPeer {
+	self := FlyPeer{AllocID: env.AllocID, Region: env.Region, IP: env.IP, Host: vmHost(env.AllocID, env.AppName)}
+	found := false
+	flyPeers := make([]FlyPeer, 0, len(peers)+1)
+	for _, peer := range peers {
+		fp := newFlyPeer(peer, env.AppName)
+		// Without an allocation ID, it's the same instance
+		// if it has the same address.
+		if fp.AllocID != "" && fp.AllocID == self.AllocID || fp.AllocID == "" && fp.IP != "" && fp.IP == self.IP {
+			found = true
+		}
+		flyPeers = append(flyPeers, fp)
+	}
+	if !found {
+		flyPeers = append(flyPeers, self)
+	}
+	return flyPeers
+}
+
+// An instance of the app. Without an allocation ID, as when it's only
+// known by its address, it's reached at its address.
+func newFlyPeer(peer privnet.Peer, app string) FlyPeer {
+	fp := FlyPeer{AllocID: privnet.ShortAllocID(peer.AllocID), Region: peer.Region}
+	if peer.IP != nil {
+		fp.IP = peer.IP.String()
+	}
+	fp.Host = vmHost(fp.AllocID, app)
+	if fp.AllocID == "" {
+		fp.Host = fp.IP
+	}
+	return fp
+}
+
+// The instance's hostname in Fly's VM DNS
+func vmHost(allocID, app string) string {
+	return fmt.Sprintf("%s.vm.%s.internal", allocID, app)
+}
+
+func getenv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
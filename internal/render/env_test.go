@@ -0,0 +1,239 @@
+package render_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/privnet/privnettest"
+	"github.com/maidata/procfly/internal/render"
+)
+
+// Discovery from a fake Fly DNS server, serving a peers
+// file, which is returned so that it can be changed
+func devDNS(t *testing.T, peers string) (privnet.Discovery, string) {
+	ns, file := privnettest.ServeDevDNS(t, peers)
+	return privnet.NewFlyDNS(ns), file
+}
+
+const clusterPeers = `
+local_ip: fdaa:0:1::2
+apps:
+  nats:
+    peers:
+    - {alloc_id: 2f9a13b7c1d2e3, region: lhr, ip: "fdaa:0:1::2"}
+    - {alloc_id: 8d1e0c44f5a6b7, region: ams, ip: "fdaa:0:1::3"}
+  redis:
+    peers:
+    - {alloc_id: 5c3b2a19e8d7c6, region: ord, ip: "fdaa:0:2::2"}
+`
+
+func TestLoadVars(t *testing.T) {
+	disc, _ := devDNS(t, clusterPeers)
+	t.Setenv("FLY_APP_NAME", "nats")
+	t.Setenv("FLY_ALLOC_ID", "2f9a13b7c1d2e3")
+	t.Setenv("FLY_REGION", "lhr")
+
+	paths := file.NewPaths(t.TempDir())
+	vars, err := render.LoadVars(paths, disc, "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := render.FlyVars{
+		Host:         "fly-local-6pn",
+		AppName:      "nats",
+		Region:       "lhr",
+		AllRegions:   []string{"ams", "lhr"},
+		IP:           "fdaa:0:1::2",
+		PeerIPs:      []string{"fdaa:0:1::2", "fdaa:0:1::3"},
+		ServerName:   "2f9a13b7c1d2e3",
+		AllocID:      "2f9a13b7",
+		PeerAllocIDs: []string{"2f9a13b7", "8d1e0c44"},
+		Peers: []render.FlyPeer{
+			{AllocID: "2f9a13b7", Region: "lhr", IP: "fdaa:0:1::2", Host: "2f9a13b7.vm.nats.internal"},
+			{AllocID: "8d1e0c44", Region: "ams", IP: "fdaa:0:1::3", Host: "8d1e0c44.vm.nats.internal"},
+		},
+		PrimaryRegion: "lhr",
+		MachineID:     "2f9a13b7c1d2e3",
+		PrivateIP:     "fdaa:0:1::2",
+		ProcessGroup:  "app",
+	}
+	if !reflect.DeepEqual(vars.Fly, want) {
+		t.Errorf("expected %+v, got %+v", want, vars.Fly)
+	}
+
+	// A clustered template, routing to the other peers
+	rndr := render.NewRenderer(paths, vars)
+	rndr.SetDiscovery(disc)
+	out := new(strings.Builder)
+	if err := rndr.Render("nats.conf", `
+{{- range .Fly.PeerIPs }}{{ if ne . $.Fly.IP }}nats://[{{ . }}]:6222 {{ end }}{{ end -}}
+{{ range (lookup "redis").VMAddrs }}redis://{{ . }}{{ end }}`, out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "nats://[fdaa:0:1::3]:6222 redis://5c3b2a19.vm.redis.internal"; out.String() != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestLoadVarsNewInstance(t *testing.T) {
+	// This instance hasn't been added to DNS yet
+	disc, _ := devDNS(t, clusterPeers)
+	t.Setenv("FLY_APP_NAME", "nats")
+	t.Setenv("FLY_ALLOC_ID", "e1d2c3b4a5968f")
+	t.Setenv("FLY_REGION", "fra")
+
+	vars, err := render.LoadVars(file.NewPaths(t.TempDir()), disc, "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2f9a13b7", "8d1e0c44", "e1d2c3b4"}; !reflect.DeepEqual(vars.Fly.PeerAllocIDs, want) {
+		t.Errorf("expected %v, got %v", want, vars.Fly.PeerAllocIDs)
+	}
+
+	if _, err := render.LoadVars(file.NewPaths(t.TempDir()), disc, "missing"); err == nil {
+		t.Error("expected an error for an app without any DNS records")
+	}
+}
+
+func TestLoadVarsPeers(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "nats")
+	t.Setenv("FLY_ALLOC_ID", "2f9a13b7c1d2e3")
+	t.Setenv("FLY_REGION", "lhr")
+
+	// Static discovery lists the full allocation IDs
+	peers := filepath.Join(t.TempDir(), "peers.yml")
+	if err := os.WriteFile(peers, []byte(clusterPeers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := render.LoadVars(file.NewPaths(t.TempDir()), privnet.NewStaticDiscovery(peers), "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []render.FlyPeer{
+		{AllocID: "2f9a13b7", Region: "lhr", IP: "fdaa:0:1::2", Host: "2f9a13b7.vm.nats.internal"},
+		{AllocID: "8d1e0c44", Region: "ams", IP: "fdaa:0:1::3", Host: "8d1e0c44.vm.nats.internal"},
+	}
+	if !reflect.DeepEqual(vars.Fly.Peers, want) {
+		t.Errorf("expected %+v, got %+v", want, vars.Fly.Peers)
+	}
+
+	// Peers without allocation IDs are reached at their addresses
+	t.Setenv("PROCFLY_NATS_PEER_IPS", "fdaa:0:1::2,fdaa:0:1::3")
+	t.Setenv("PROCFLY_LOCAL_IP", "fdaa:0:1::2")
+	vars, err = render.LoadVars(file.NewPaths(t.TempDir()), privnet.NewEnvDiscovery(""), "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []render.FlyPeer{
+		{Region: "local", IP: "fdaa:0:1::2", Host: "fdaa:0:1::2"},
+		{Region: "local", IP: "fdaa:0:1::3", Host: "fdaa:0:1::3"},
+	}
+	if !reflect.DeepEqual(vars.Fly.Peers, want) {
+		t.Errorf("expected %+v, got %+v", want, vars.Fly.Peers)
+	}
+}
+
+func TestLoadVarsLocal(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "")
+	t.Setenv("FLY_ALLOC_ID", "")
+	t.Setenv("FLY_REGION", "")
+
+	// Without an app, nothing is discovered
+	vars, err := render.LoadVars(file.NewPaths(t.TempDir()), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := render.FlyVars{
+		Host:       "localhost",
+		AppName:    "local",
+		Region:     "local",
+		AllRegions: []string{"local"},
+		ServerName: "local-id",
+		AllocID:    "local-id",
+		Peers: []render.FlyPeer{
+			{AllocID: "local-id", Region: "local", Host: "localhost"},
+		},
+		PrimaryRegion: "local",
+		MachineID:     "local-id",
+		ProcessGroup:  "app",
+	}
+	if !reflect.DeepEqual(vars.Fly, want) {
+		t.Errorf("expected %+v, got %+v", want, vars.Fly)
+	}
+}
+
+func TestLoadVarsPeerChanges(t *testing.T) {
+	disc, peers := devDNS(t, clusterPeers)
+	t.Setenv("FLY_APP_NAME", "nats")
+	t.Setenv("FLY_ALLOC_ID", "2f9a13b7c1d2e3")
+
+	paths := file.NewPaths(t.TempDir())
+	prev, err := render.LoadVars(paths, disc, "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One peer is replaced by another
+	if err := os.WriteFile(peers, []byte(strings.Replace(clusterPeers, `8d1e0c44f5a6b7, region: ams, ip: "fdaa:0:1::3"`, `c0ffee00d1e2f3, region: ams, ip: "fdaa:0:1::4"`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	next, err := render.LoadVars(paths, disc, "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next.Fly.DiffPeers(prev.Fly.PeerIPs)
+	if want := []string{"fdaa:0:1::4"}; !reflect.DeepEqual(next.Fly.PeersAdded, want) {
+		t.Errorf("expected %v added, got %v", want, next.Fly.PeersAdded)
+	}
+	if want := []string{"fdaa:0:1::3"}; !reflect.DeepEqual(next.Fly.PeersRemoved, want) {
+		t.Errorf("expected %v removed, got %v", want, next.Fly.PeersRemoved)
+	}
+
+	next.Fly.DiffPeers(next.Fly.PeerIPs)
+	if next.Fly.PeersAdded != nil || next.Fly.PeersRemoved != nil {
+		t.Errorf("expected no changes, got %v & %v", next.Fly.PeersAdded, next.Fly.PeersRemoved)
+	}
+}
+
+func TestLoadVarsMachineEnv(t *testing.T) {
+	disc, _ := devDNS(t, clusterPeers)
+	for key, value := range map[string]string{
+		"FLY_APP_NAME":      "nats",
+		"FLY_ALLOC_ID":      "e1d2c3",
+		"FLY_MACHINE_ID":    "e1d2c3",
+		"FLY_REGION":        "fra",
+		"PRIMARY_REGION":    "lhr",
+		"FLY_IMAGE_REF":     "registry.fly.io/nats:deployment-01H",
+		"FLY_PUBLIC_IP":     "2a09:8280:1::1",
+		"FLY_PRIVATE_IP":    "fdaa:0:1::5",
+		"FLY_PROCESS_GROUP": "worker",
+		"FLY_VM_MEMORY_MB":  "512",
+	} {
+		t.Setenv(key, value)
+	}
+
+	// Short alloc IDs are used as they are
+	vars, err := render.LoadVars(file.NewPaths(t.TempDir()), disc, "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fly := vars.Fly
+	if fly.AllocID != "e1d2c3" || fly.MachineID != "e1d2c3" || fly.PrimaryRegion != "lhr" ||
+		fly.ImageRef != "registry.fly.io/nats:deployment-01H" || fly.PublicIP != "2a09:8280:1::1" ||
+		fly.PrivateIP != "fdaa:0:1::5" || fly.ProcessGroup != "worker" || fly.VMMemoryMB != 512 {
+		t.Errorf("machine environment wasn't loaded: %+v", fly)
+	}
+
+	// This instance isn't in DNS yet, but is still a peer
+	want := render.FlyPeer{AllocID: "e1d2c3", Region: "fra", IP: "fdaa:0:1::2", Host: "e1d2c3.vm.nats.internal"}
+	if len(fly.Peers) != 3 || fly.Peers[2] != want {
+		t.Errorf("expected %+v as the last peer, got %+v", want, fly.Peers)
+	}
+}
@@ -2,38 +2,809 @@ package render
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/maidata/procfly/internal/privnet"
+	"gopkg.in/yaml.v3"
 )
 
+// The functions available to every template, which are listed in the
+// README. Where a function shares its name with one from sprig, it takes
+// the same arguments, in the same order, so that it can be piped in the
+// same way. Differences in their results are noted in the README.
 var funcs = template.FuncMap{
 	"timestamp": time.Now,
-	"lookup":    lookupApp,
+
+	// Strings
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+	"split":      split,
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"quote":      quote,
+	"squote":     squote,
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+
+	// Templates. include is bound to each template as it's parsed.
+	"include": func(string, any) (string, error) { return "", errors.New("include is unavailable") },
+
+	// Defaults & checks
+	"default":  defaultValue,
+	"empty":    empty,
+	"coalesce": coalesce,
+	"ternary":  ternary,
+	"required": required,
+	"fail":     func(msg string) (string, error) { return "", errors.New(msg) },
+
+	// Lists
+	"list":      func(items ...any) []any { return items },
+	"first":     first,
+	"last":      last,
+	"rest":      rest,
+	"initial":   initial,
+	"has":       has,
+	"indexOf":   indexOf,
+	"without":   without,
+	"uniq":      uniq,
+	"compact":   compact,
+	"reverse":   reverse,
+	"append":    appendList,
+	"prepend":   prependList,
+	"concat":    concat,
+	"sortAlpha": sortAlpha,
+	"until":     until,
+
+	// Dictionaries
+	"dict":   dict,
+	"get":    get,
+	"set":    set,
+	"hasKey": hasKey,
+	"keys":   keys,
+	"values": values,
+
+	// Maths, on integers unless noted otherwise
+	"add":   func(values ...any) (int64, error) { return fold(values, func(a, b int64) int64 { return a + b }) },
+	"add1":  func(v any) (int64, error) { i, err := toInt64(v); return i + 1, err },
+	"sub":   func(a, b any) (int64, error) { return fold([]any{a, b}, func(a, b int64) int64 { return a - b }) },
+	"mul":   func(values ...any) (int64, error) { return fold(values, func(a, b int64) int64 { return a * b }) },
+	"div":   div,
+	"mod":   mod,
+	"max":   func(values ...any) (int64, error) { return fold(values, maxInt) },
+	"min":   func(values ...any) (int64, error) { return fold(values, minInt) },
+	"floor": func(v any) (float64, error) { f, err := toFloat64(v); return math.Floor(f), err },
+	"ceil":  func(v any) (float64, error) { f, err := toFloat64(v); return math.Ceil(f), err },
+	"round": round,
+
+	// Conversions & encodings
+	"toString":     toString,
+	"atoi":         func(s string) (int, error) { return strconv.Atoi(strings.TrimSpace(s)) },
+	"int":          func(v any) (int, error) { i, err := toInt64(v); return int(i), err },
+	"int64":        toInt64,
+	"float64":      toFloat64,
+	"toJson":       toJSON,
+	"toPrettyJson": toPrettyJSON,
+	"fromJson":     fromJSON,
+	"toYaml":       toYAML,
+	"fromYaml":     fromYAML,
+	"toToml":       toTOML,
+	"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":       b64dec,
+	"sha1sum":      func(s string) string { sum := sha1.Sum([]byte(s)); return hex.EncodeToString(sum[:]) },
+	"sha256sum":    func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+
+	// The environment
+	"env":       env,
+	"expandenv": os.ExpandEnv,
+}
+
+// Functions that depend on the renderer, to resolve files against
+// the root directory, and to refresh when the files they read change.
+func (r *Renderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		// The absolute path of a file in the root directory
+		"file": r.paths.Resolve,
+		// The contents of a file in the root directory
+		"readFile": func(file string) (string, error) {
+			r.addSource(file)
+			content, err := r.paths.Read(file)
+			return string(content), err
+		},
+		// The instances of another app
+		"lookup": r.lookupApp,
+		// A secret, failing if it isn't set
+		"secret": func(name string) (string, error) {
+			r.mu.Lock()
+			value, ok := r.secrets[name]
+			r.mu.Unlock()
+			if !ok {
+				return "", fmt.Errorf("secret %q isn't set", name)
+			}
+			return value, nil
+		},
+		// Like readFile, with the trimmed contents treated as a secret
+		"secretFile": func(file string) (string, error) {
+			r.addSource(file)
+			content, err := r.paths.Read(file)
+			if err != nil {
+				return "", err
+			}
+			value := strings.TrimRight(string(content), "\r\n")
+			r.redactor.Add(value)
+			return value, nil
+		},
+	}
+}
+
+// Upper-cases the first letter of each word
+func title(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
+
+// As in sprig, split returns a dict keyed by "_0", "_1", etc, so that
+// parts can be picked out with a dot. splitList returns a list.
+func split(sep, s string) map[string]string {
+	parts := strings.Split(s, sep)
+	res := make(map[string]string, len(parts))
+	for i, part := range parts {
+		res["_"+strconv.Itoa(i)] = part
+	}
+	return res
+}
+
+func join(sep string, list any) (string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = toString(item)
+	}
+	return strings.Join(strs, sep), nil
+}
+
+// Indents every line of the string by the number of spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// Double quotes each of the values, escaping them as Go strings
+func quote(values ...any) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			quoted = append(quoted, strconv.Quote(toString(v)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Single quotes each of the values, without escaping them
+func squote(values ...any) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			quoted = append(quoted, "'"+toString(v)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Returns def if the value isn't given, or is empty
+func defaultValue(def any, given ...any) any {
+	if len(given) == 0 || empty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// Reports whether the value is nil, a zero value or an empty collection
+func empty(v any) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+// The first value that isn't empty
+func coalesce(values ...any) any {
+	for _, v := range values {
+		if !empty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func ternary(yes, no any, cond bool) any {
+	if cond {
+		return yes
+	}
+	return no
+}
+
+// Fails rendering with the message if the value is empty
+func required(msg string, v any) (any, error) {
+	if empty(v) {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+func toList(list any) ([]any, error) {
+	switch l := list.(type) {
+	case []any:
+		return l, nil
+	case nil:
+		return nil, nil
+	}
+
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", list)
+	}
+	items := make([]any, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, nil
+}
+
+func first(list any) (any, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+func last(list any) (any, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[len(items)-1], nil
+}
+
+// All but the first item
+func rest(list any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[1:], nil
+}
+
+// All but the last item
+func initial(list any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[:len(items)-1], nil
+}
+
+func has(needle any, list any) (bool, error) {
+	i, err := indexOf(list, needle)
+	return i >= 0, err
+}
+
+// The index of the first item equal to the value, or -1
+func indexOf(list any, v any) (int, error) {
+	items, err := toList(list)
+	if err != nil {
+		return -1, err
+	}
+	for i, item := range items {
+		if reflect.DeepEqual(item, v) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// The list, without any of the given values
+func without(list any, omit ...any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, 0, len(items))
+	for _, item := range items {
+		if i, _ := indexOf(omit, item); i < 0 {
+			res = append(res, item)
+		}
+	}
+	return res, nil
+}
+
+func uniq(list any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, 0, len(items))
+	for _, item := range items {
+		if i, _ := indexOf(res, item); i < 0 {
+			res = append(res, item)
+		}
+	}
+	return res, nil
+}
+
+// The list, without any empty values
+func compact(list any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, 0, len(items))
+	for _, item := range items {
+		if !empty(item) {
+			res = append(res, item)
+		}
+	}
+	return res, nil
+}
+
+func reverse(list any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, len(items))
+	for i, item := range items {
+		res[len(items)-1-i] = item
+	}
+	return res, nil
+}
+
+func appendList(list any, v any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]any(nil), items...), v), nil
+}
+
+func prependList(list any, v any) ([]any, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	return append([]any{v}, items...), nil
+}
+
+func concat(lists ...any) ([]any, error) {
+	var res []any
+	for _, list := range lists {
+		items, err := toList(list)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, items...)
+	}
+	return res, nil
+}
+
+// Sorts the items alphabetically, as strings
+func sortAlpha(list any) ([]string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = toString(item)
+	}
+	sort.Strings(strs)
+	return strs, nil
+}
+
+// The integers from 0 up to, but not including, n
+func until(n int) []int {
+	res := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, i)
+	}
+	return res
+}
+
+// Builds a dict from alternating keys & values
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict expects an even number of arguments")
+	}
+	d := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		d[toString(pairs[i])] = pairs[i+1]
+	}
+	return d, nil
+}
+
+// Dicts may be any map with string keys, such as .Env
+func dictValue(d any) (reflect.Value, error) {
+	rv := reflect.ValueOf(d)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return rv, fmt.Errorf("expected a dict, got %T", d)
+	}
+	return rv, nil
+}
+
+func dictKey(rv reflect.Value, key string) reflect.Value {
+	return reflect.ValueOf(key).Convert(rv.Type().Key())
+}
+
+// The dict's value for key, or nil if it isn't set
+func get(d any, key string) (any, error) {
+	rv, err := dictValue(d)
+	if err != nil {
+		return nil, err
+	}
+	if v := rv.MapIndex(dictKey(rv, key)); v.IsValid() {
+		return v.Interface(), nil
+	}
+	return nil, nil
+}
+
+func hasKey(d any, key string) (bool, error) {
+	rv, err := dictValue(d)
+	if err != nil {
+		return false, err
+	}
+	return rv.MapIndex(dictKey(rv, key)).IsValid(), nil
+}
+
+// Set the key in the dict, returning the dict
+func set(d any, key string, value any) (any, error) {
+	rv, err := dictValue(d)
+	if err != nil {
+		return nil, err
+	} else if rv.IsNil() {
+		return nil, errors.New("can't set a key in a nil dict")
+	}
+
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		v = reflect.Zero(rv.Type().Elem())
+	} else if !v.Type().AssignableTo(rv.Type().Elem()) {
+		return nil, fmt.Errorf("can't set a %T in a %T", value, d)
+	}
+	rv.SetMapIndex(dictKey(rv, key), v)
+	return d, nil
+}
+
+// The dicts' keys, sorted
+func keys(dicts ...any) ([]string, error) {
+	var res []string
+	for _, d := range dicts {
+		rv, err := dictValue(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range rv.MapKeys() {
+			res = append(res, k.String())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// The dict's values, sorted by their keys
+func values(d any) ([]any, error) {
+	ks, err := keys(d)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(d)
+	res := make([]any, 0, len(ks))
+	for _, k := range ks {
+		res = append(res, rv.MapIndex(dictKey(rv, k)).Interface())
+	}
+	return res, nil
 }
 
-func lookupApp(app string) (vars AppVars, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func fold(values []any, fn func(a, b int64) int64) (int64, error) {
+	if len(values) == 0 {
+		return 0, errors.New("expected at least one value")
+	}
+	acc, err := toInt64(values[0])
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range values[1:] {
+		i, err := toInt64(v)
+		if err != nil {
+			return 0, err
+		}
+		acc = fn(acc, i)
+	}
+	return acc, nil
+}
 
-	vars.Name = app
-	vars.AllocIDs, err = privnet.AllPeerAllocIDs(ctx, app)
+func div(a, b any) (int64, error) {
+	x, y, err := toInt64Pair(a, b)
+	if err == nil && y == 0 {
+		err = errors.New("division by zero")
+	}
 	if err != nil {
-		return
+		return 0, err
 	}
+	return x / y, nil
+}
 
-	vars.VMAddrs = make([]string, len(vars.AllocIDs))
-	for idx, allocID := range vars.AllocIDs {
-		vars.VMAddrs[idx] = fmt.Sprintf("%s.vm.%s.internal", allocID, app)
+func mod(a, b any) (int64, error) {
+	x, y, err := toInt64Pair(a, b)
+	if err == nil && y == 0 {
+		err = errors.New("division by zero")
 	}
+	if err != nil {
+		return 0, err
+	}
+	return x % y, nil
+}
+
+func maxInt(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
 
-	return
+func minInt(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// As in sprig, rounds to the number of decimal places, rounding up
+// from roundOn, which defaults to .5
+func round(v any, places int, roundOn ...float64) (float64, error) {
+	f, err := toFloat64(v)
+	if err != nil {
+		return 0, err
+	}
+	on := .5
+	if len(roundOn) > 0 {
+		on = roundOn[0]
+	}
+
+	pow := math.Pow(10, float64(places))
+	digits := pow * f
+	if _, frac := math.Modf(digits); frac >= on {
+		return math.Ceil(digits) / pow, nil
+	}
+	return math.Floor(digits) / pow, nil
+}
+
+func toInt64Pair(a, b any) (int64, int64, error) {
+	x, err := toInt64(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := toInt64(b)
+	return x, y, err
+}
+
+func toInt64(v any) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return int64(rv.Float()), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.String:
+		return strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64)
+	}
+	return 0, fmt.Errorf("can't convert %T to an integer", v)
+}
+
+func toFloat64(v any) (float64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+	}
+	i, err := toInt64(v)
+	return float64(i), err
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+func toJSON(v any) (string, error) {
+	p, err := json.Marshal(v)
+	return string(p), err
+}
+
+func toPrettyJSON(v any) (string, error) {
+	p, err := json.MarshalIndent(v, "", "  ")
+	return string(p), err
+}
+
+func fromJSON(s string) (any, error) {
+	var v any
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// Encodes the value as YAML, indented by 2 spaces like sprig's,
+// without a trailing newline
+func toYAML(v any) (string, error) {
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func fromYAML(s string) (any, error) {
+	var v any
+	err := yaml.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+func b64dec(s string) (string, error) {
+	p, err := base64.StdEncoding.DecodeString(s)
+	return string(p), err
+}
+
+// An environment variable, or the default if it's unset or empty
+func env(name string, def ...string) string {
+	if value := os.Getenv(name); value != "" || len(def) == 0 {
+		return value
+	}
+	return def[0]
+}
+
+// Look up the instances of an app, by a name like those in Fly's DNS:
+//
+//	<app>                   every instance
+//	<region>.<app>          the instances in a region
+//	top<n>.nearest.of.<app> the n nearest instances, in no particular order
+//
+// optionally ending in .internal. Results, and failures, are kept until
+// the renderer is reset, so that templates can look the same app up over
+// & over again with a single query. Queries are timed out by the
+// discovery itself.
+func (r *Renderer) lookupApp(name string) (AppVars, error) {
+	key := strings.TrimSuffix(strings.ToLower(name), ".internal")
+	r.mu.Lock()
+	prev, ok := r.lookups[key]
+	disc := r.discovery
+	r.mu.Unlock()
+	if ok {
+		return prev.vars, prev.err
+	}
+
+	vars, err := findApp(disc, name, key)
+	r.mu.Lock()
+	r.lookups[key] = appLookup{vars: vars, err: err}
+	r.mu.Unlock()
+	return vars, err
+}
+
+// A looked up app, or why it couldn't be
+type appLookup struct {
+	vars AppVars
+	err  error
+}
+
+// Look the app up with disc, by its name's key, which is lowercase
+// without the .internal suffix
+func findApp(disc privnet.Discovery, name, key string) (AppVars, error) {
+	var vars AppVars
+	var peers []privnet.Peer
+	var err error
+	ctx := context.Background()
+	labels := strings.Split(key, ".")
+	switch {
+	case len(labels) == 1:
+		vars.Name = labels[0]
+		peers, err = disc.Peers(ctx, vars.Name)
+	case len(labels) == 2:
+		vars.Name, vars.Region = labels[1], labels[0]
+		peers, err = disc.RegionPeers(ctx, vars.Name, vars.Region)
+	case len(labels) == 4 && strings.HasPrefix(labels[0], "top") && labels[1] == "nearest" && labels[2] == "of":
+		n, convErr := strconv.Atoi(strings.TrimPrefix(labels[0], "top"))
+		if convErr != nil || n < 1 {
+			return vars, fmt.Errorf("invalid lookup %q: expected top1 or more", name)
+		}
+		vars.Name = labels[3]
+		peers, err = disc.Nearest(ctx, vars.Name, n)
+	default:
+		return vars, fmt.Errorf("invalid lookup %q: expected <app>, <region>.<app> or top<n>.nearest.of.<app>", name)
+	}
+	if err != nil {
+		return vars, err
+	}
+
+	vars.Instances = make([]FlyPeer, len(peers))
+	vars.AllocIDs = make([]string, len(peers))
+	vars.VMAddrs = make([]string, len(peers))
+	for i, peer := range peers {
+		vars.Instances[i] = newFlyPeer(peer, vars.Name)
+		vars.AllocIDs[i] = vars.Instances[i].AllocID
+		vars.VMAddrs[i] = vars.Instances[i].Host
+	}
+	return vars, nil
 }
 
 type AppVars struct {
-	Name     string
+	Name string
+	// The region looked up, if any
+	Region   string
 	AllocIDs []string
 	VMAddrs  []string
+	// Each instance, with its region, private IP & VM address
+	Instances []FlyPeer
 }
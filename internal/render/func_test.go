@@ -0,0 +1,213 @@
+package render_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestFuncs(t *testing.T) {
+	t.Setenv("PROCFLY_TEST_SET", "set")
+
+	paths := file.NewPaths(t.TempDir())
+	if err := os.WriteFile(filepath.Join(paths.RootDir, "peers.txt"), []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]any{
+		"Name":    "nats",
+		"Empty":   "",
+		"Regions": []string{"lhr", "ams", "fra"},
+		"Config":  map[string]any{"port": 4222, "cluster": map[string]any{"name": "c1", "routes": []string{"a", "b"}}},
+		"Env":     render.EnvVars{"PORT": "4222", "HOST": "nats"},
+	}
+
+	for _, tt := range []struct {
+		tmpl string
+		want string
+	}{
+		// Strings
+		{`{{ "  x " | trim }}`, "x"},
+		{`{{ .Name | upper }}`, "NATS"},
+		{`{{ "hello world" | title }}`, "Hello World"},
+		{`{{ "a-b-c" | replace "-" "." }}`, "a.b.c"},
+		{`{{ .Name | trimPrefix "n" | trimSuffix "s" }}`, "at"},
+		{`{{ (split ":" "host:4222")._1 }}`, "4222"},
+		{`{{ splitList "," "a,b" | join "+" }}`, "a+b"},
+		{`{{ .Regions | join "," }}`, "lhr,ams,fra"},
+		{`{{ .Name | quote }} {{ .Name | squote }}`, `"nats" 'nats'`},
+		{`{{ contains "at" .Name }} {{ hasPrefix "na" .Name }}`, "true true"},
+
+		// Defaults
+		{`{{ .Empty | default "fallback" }}`, "fallback"},
+		{`{{ .Name | default "fallback" }}`, "nats"},
+		{`{{ .Missing | default 8 }}`, "8"},
+		{`{{ coalesce .Empty .Missing "c" }}`, "c"},
+		{`{{ empty .Empty }} {{ empty .Regions }}`, "true false"},
+		{`{{ ternary "yes" "no" true }}`, "yes"},
+		{`{{ required "need a name" .Name }}`, "nats"},
+
+		// Lists
+		{`{{ has "ams" .Regions }} {{ has "sin" .Regions }}`, "true false"},
+		{`{{ indexOf .Regions "fra" }} {{ indexOf .Regions "sin" }}`, "2 -1"},
+		{`{{ without .Regions "ams" | join "," }}`, "lhr,fra"},
+		{`{{ .Regions | sortAlpha | join "," }}`, "ams,fra,lhr"},
+		{`{{ first .Regions }} {{ last .Regions }}`, "lhr fra"},
+		{`{{ rest .Regions | join "," }}|{{ initial .Regions | join "," }}`, "ams,fra|lhr,ams"},
+		{`{{ list 1 1 2 "" 3 | compact | uniq | reverse | join "," }}`, "3,2,1"},
+		{`{{ prepend (append .Regions "sin") "iad" | join "," }}`, "iad,lhr,ams,fra,sin"},
+		{`{{ range until 3 }}{{ . }}{{ end }}`, "012"},
+
+		// Dictionaries
+		{`{{ $d := dict "a" 1 "b" 2 }}{{ keys $d | join "," }} {{ get $d "b" }} {{ hasKey $d "c" }}`, "a,b 2 false"},
+		{`{{ get .Env "PORT" }} {{ hasKey .Env "HOST" }} {{ hasKey .Env "USER" }}`, "4222 true false"},
+		{`{{ keys .Env | join "," }} {{ values .Env | join "," }}`, "HOST,PORT nats,4222"},
+		{`{{ $d := set (dict) "a" 1 }}{{ get $d "a" }} {{ (set .Env "USER" "app").USER }}`, "1 app"},
+
+		// Maths
+		{`{{ add 1 2 3 }} {{ sub 5 2 }} {{ mul 2 "3" }} {{ div 7 2 }} {{ mod 7 2 }}`, "6 3 6 3 1"},
+		{`{{ max 1 5 3 }} {{ min 4 2 }} {{ add1 9 }}`, "5 2 10"},
+		{`{{ floor 1.5 }} {{ ceil 1.5 }} {{ round 2.5 0 }}`, "1 2 3"},
+		{`{{ round 3.14159 2 }} {{ round 2.46 1 0.7 }}`, "3.14 2.4"},
+
+		// Encodings
+		{`{{ .Regions | toJson }}`, `["lhr","ams","fra"]`},
+		{`{{ (fromJson "{\"a\":[1,2]}").a | len }}`, "2"},
+		{`{{ .Config | toYaml }}`, "cluster:\n  name: c1\n  routes:\n    - a\n    - b\nport: 4222"},
+		{`{{ .Config | toToml }}`, "port = 4222\n\n[cluster]\nname = \"c1\"\nroutes = [\"a\", \"b\"]"},
+		{`{{ "procfly" | b64enc }} {{ "cHJvY2ZseQ==" | b64dec }}`, "cHJvY2ZseQ== procfly"},
+		{`{{ "procfly" | sha256sum }}`, "e31fc9bd51682d5ffd23ffbbcf46126e5ee8ab639ad439dd70c6e862d62f1db5"},
+
+		// Environment & files
+		{`{{ env "PROCFLY_TEST_SET" }} {{ env "PROCFLY_TEST_UNSET" "def" }}`, "set def"},
+		{`{{ readFile "peers.txt" | trim }}`, "a\nb"},
+		{`{{ file "peers.txt" }}`, filepath.Join(paths.RootDir, "peers.txt")},
+	} {
+		rndr := render.NewRenderer(paths, vars)
+		buf := new(bytes.Buffer)
+		if err := rndr.Render("test", tt.tmpl, buf); err != nil {
+			t.Errorf("%s: %s", tt.tmpl, err)
+		} else if buf.String() != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.tmpl, tt.want, buf.String())
+		}
+	}
+}
+
+func TestFuncErrors(t *testing.T) {
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), map[string]any{
+		"Regions": []string{"lhr"},
+		"Env":     render.EnvVars{},
+	})
+
+	for _, tt := range []struct {
+		tmpl string
+		want string
+	}{
+		{`{{ required "the region must be set" .Region }}`, "the region must be set"},
+		{`{{ fail "unsupported" }}`, "unsupported"},
+		{`{{ div 1 0 }}`, "division by zero"},
+		{`{{ dict "a" }}`, "even number of arguments"},
+		{`{{ get .Regions "a" }}`, "expected a dict"},
+		{`{{ set .Env "PORT" 4222 }}`, "can't set a int"},
+		{`{{ readFile "missing.txt" }}`, "no such file"},
+	} {
+		err := rndr.Render("test", tt.tmpl, new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.tmpl, tt.want, err)
+		}
+	}
+}
+
+func TestReadFileSources(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	if err := os.WriteFile(filepath.Join(paths.RootDir, "token"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rndr := render.NewRenderer(paths, nil)
+	if err := rndr.Render("test", `{{ readFile "token" }}`, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file read by a template should trigger a refresh when it changes
+	if sources := rndr.Sources(); len(sources) != 1 || sources[0] != filepath.Join(paths.RootDir, "token") {
+		t.Errorf("unexpected sources: %v", sources)
+	}
+}
+
+// Counts the instances looked up, to check that lookups are cached
+type countingDiscovery struct {
+	privnet.Discovery
+	lookups int
+}
+
+func (c *countingDiscovery) Peers(ctx context.Context, app string) ([]privnet.Peer, error) {
+	c.lookups++
+	return c.Discovery.Peers(ctx, app)
+}
+
+func TestLookup(t *testing.T) {
+	disc, _ := devDNS(t, clusterPeers)
+	counting := &countingDiscovery{Discovery: disc}
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), nil)
+	rndr.SetDiscovery(counting)
+
+	for _, tt := range []struct {
+		tmpl string
+		want string
+	}{
+		{`{{ range (lookup "nats").Instances }}{{ .AllocID }}@{{ .Region }}={{ .IP }} {{ end }}`, "2f9a13b7@lhr=fdaa:0:1::2 8d1e0c44@ams=fdaa:0:1::3 "},
+		{`{{ with lookup "ams.nats" }}{{ .Name }} {{ .Region }} {{ .VMAddrs }}{{ end }}`, "nats ams [8d1e0c44.vm.nats.internal]"},
+		{`{{ (lookup "fra.nats").AllocIDs }}`, "[]"},
+		// This instance is in lhr
+		{`{{ range (lookup "top1.nearest.of.nats.internal").Instances }}{{ .Host }}{{ end }}`, "2f9a13b7.vm.nats.internal"},
+		{`{{ (lookup "REDIS.internal").AllocIDs }}`, "[5c3b2a19]"},
+	} {
+		buf := new(bytes.Buffer)
+		if err := rndr.Render("test", tt.tmpl, buf); err != nil {
+			t.Errorf("%s: %v", tt.tmpl, err)
+		} else if buf.String() != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.tmpl, tt.want, buf.String())
+		}
+	}
+
+	for _, name := range []string{"a.b.c", "top0.nearest.of.nats", "missing"} {
+		if err := rndr.Render("test", `{{ lookup "`+name+`" }}`, new(bytes.Buffer)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Looking the same app up again doesn't query it again, until a reset
+	counting.lookups = 0
+	tmpl := `{{ range until 10 }}{{ len (lookup "nats").Instances }}{{ end }}`
+	if err := rndr.Render("test", tmpl, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if counting.lookups != 0 {
+		t.Errorf("expected the cached lookup to be used, got %d lookups", counting.lookups)
+	}
+	rndr.Reset(nil)
+	if err := rndr.Render("test", tmpl, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if counting.lookups != 1 {
+		t.Errorf("expected 1 lookup after a reset, got %d", counting.lookups)
+	}
+	// Failures are kept too
+	counting.lookups = 0
+	for i := 0; i < 2; i++ {
+		if err := rndr.Render("test", `{{ lookup "missing" }}`, new(bytes.Buffer)); err == nil {
+			t.Error("expected an error for a missing app")
+		}
+	}
+	if counting.lookups != 1 {
+		t.Errorf("expected the failed lookup to be kept, got %d lookups", counting.lookups)
+	}
+}
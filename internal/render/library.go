@@ -0,0 +1,115 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/maidata/procfly/internal/util"
+)
+
+// The template library loaded when none is configured
+const DefaultLibrary = "partials/*"
+
+// Load the files matching the patterns, relative to the root directory, as
+// named templates that every other template can use. Each file is named
+// after its base name, without its extension, so partials/routes.tmpl can
+// be used with {{ template "routes" . }} or {{ include "routes" . }}. Any
+// templates defined inside the files are available too.
+//
+// The library's files are re-read each time it's loaded, and templates are
+// re-parsed if any of them have changed, as they're cached by the library's
+// hash. If the library can't be loaded, the previous one is kept.
+func (r *Renderer) Library(patterns ...string) error {
+	files, err := r.libraryFiles(patterns)
+	if err != nil {
+		return err
+	}
+
+	lib := template.New("").Funcs(funcs).Funcs(r.funcs())
+	hashed := make([]any, 0, 2*len(files))
+	for _, path := range files {
+		r.addSource(path)
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hashed = append(hashed, path, content)
+
+		base := filepath.Base(path)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		if lib.Lookup(name) != nil {
+			return fmt.Errorf("%s: template %q is already defined", path, name)
+		}
+		if _, err := lib.New(name).Parse(string(content)); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	hash, err := util.Hash(hashed...)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hash != r.libHash {
+		r.lib, r.libHash = lib, hash
+	}
+	return nil
+}
+
+func (r *Renderer) libraryFiles(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(r.paths.Resolve(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		r.addSourceDir(patternDir(r.paths.Resolve(pattern)))
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				seen[match] = true
+			}
+		}
+	}
+
+	files := make([]string, 0, len(seen))
+	for file := range seen {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Parse a template alongside the library
+func (r *Renderer) parse(lib *template.Template, name, tmpl string) (*template.Template, error) {
+	var t *template.Template
+	if lib != nil {
+		lib, err := lib.Clone()
+		if err != nil {
+			return nil, err
+		}
+		t = lib.New(name)
+	} else {
+		t = template.New(name).Funcs(funcs).Funcs(r.funcs())
+	}
+
+	if _, err := t.Parse(tmpl); err != nil {
+		return nil, err
+	}
+
+	// Like template, but its output can be piped
+	return t.Funcs(template.FuncMap{
+		"include": func(name string, data any) (string, error) {
+			buf := new(bytes.Buffer)
+			err := t.ExecuteTemplate(buf, name, data)
+			return buf.String(), err
+		},
+	}), nil
+}
@@ -0,0 +1,72 @@
+package render_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestLibrary(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	write := func(name, content string) {
+		path := filepath.Join(paths.RootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(rndr *render.Renderer, tmpl string) string {
+		buf := new(bytes.Buffer)
+		if err := rndr.Render("test", tmpl, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	write("partials/routes.tmpl", "routes: [\n{{- range . }}\n  {{ . }},\n{{- end }}\n]")
+	write("partials/helpers.tmpl", `{{ define "port" }}4222{{ end }}`)
+
+	rndr := render.NewRenderer(paths, []string{"a", "b"})
+	if err := rndr.Library(render.DefaultLibrary); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := run(rndr, `{{ template "routes" . }}`); got != "routes: [\n  a,\n  b,\n]" {
+		t.Errorf("unexpected template output: %q", got)
+	}
+	if got := run(rndr, `cluster:{{ include "routes" . | nindent 2 }}`); got != "cluster:\n  routes: [\n    a,\n    b,\n  ]" {
+		t.Errorf("unexpected include output: %q", got)
+	}
+	if got := run(rndr, `port: {{ template "port" }}`); got != "port: 4222" {
+		t.Errorf("unexpected define output: %q", got)
+	}
+
+	// A changed partial should be picked up by the templates using it
+	write("partials/helpers.tmpl", `{{ define "port" }}4333{{ end }}`)
+	rndr.Reset(nil)
+	if err := rndr.Library(render.DefaultLibrary); err != nil {
+		t.Fatal(err)
+	}
+	if got := run(rndr, `port: {{ template "port" }}`); got != "port: 4333" {
+		t.Errorf("partial change wasn't picked up: %q", got)
+	}
+	// Along with their directory, for new partials to be picked up
+	if len(rndr.Sources()) != 3 {
+		t.Errorf("expected the partials & their directory to be sources, got %v", rndr.Sources())
+	}
+
+	// A broken partial leaves the previous library in place
+	write("partials/helpers.tmpl", `{{ define "port" }}`)
+	if err := rndr.Library(render.DefaultLibrary); err == nil {
+		t.Error("expected an error loading a broken library")
+	}
+	if got := run(rndr, `port: {{ template "port" }}`); got != "port: 4333" {
+		t.Errorf("previous library wasn't kept: %q", got)
+	}
+}
@@ -0,0 +1,353 @@
+package render
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/maidata/procfly/internal/privnet"
+)
+
+var ErrUnknownPlatform = errors.New("unknown platform")
+
+// Where procfly is running, described the same way on every platform
+type PlatformVars struct {
+	// One of fly, kubernetes, docker or host
+	Name string
+	// The app, service or deployment that this instance is part of
+	App string
+	// This instance's ID, such as its machine ID, pod name or container ID
+	InstanceID string
+	Hostname   string
+	// Where this instance runs. Outside of Fly, it's REGION, or local.
+	Region string
+	IP     string
+	// Every instance of the app, including this one
+	Peers []PlatformPeer
+	// Anything else the platform provides, such as a pod's namespace
+	Meta map[string]string
+	// A pod's labels, from the downward API
+	Labels map[string]string
+}
+
+type PlatformPeer struct {
+	ID     string
+	Region string
+	IP     string
+	Host   string
+}
+
+// A Platform loads the variables for where procfly is running
+type Platform interface {
+	// Load the variables for the app, which may be empty if the instance
+	// is running alone. fly holds the already loaded Fly variables.
+	Load(ctx context.Context, app string, fly FlyVars) (PlatformVars, error)
+	// Log failures that are worked around, such as peers that can't
+	// be looked up
+	SetLogf(logf func(format string, args ...any))
+}
+
+// Open the named platform, or the detected one if it's auto or empty.
+// Peers are looked up with the discovery's timeouts, retries & caching.
+func OpenPlatform(name string, conf privnet.DiscoveryConfig) (Platform, error) {
+	if name == "" || name == "auto" {
+		name = DetectPlatform()
+	}
+
+	switch name {
+	case "fly":
+		return new(flyPlatform), nil
+	case "kubernetes":
+		return &kubernetesPlatform{
+			podinfo: getenv("PROCFLY_PODINFO_DIR", "/etc/podinfo"),
+			disc:    platformDiscovery(conf),
+		}, nil
+	case "docker":
+		return &dockerPlatform{disc: platformDiscovery(conf)}, nil
+	case "host":
+		return new(hostPlatform), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlatform, name)
+	}
+}
+
+// Guess the platform from its environment
+func DetectPlatform() string {
+	switch {
+	case os.Getenv("FLY_APP_NAME") != "" || os.Getenv("FLY_ALLOC_ID") != "":
+		return "fly"
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		return "kubernetes"
+	case exists("/.dockerenv") || exists("/run/.containerenv"):
+		return "docker"
+	default:
+		return "host"
+	}
+}
+
+// Peers are found by looking up the app with the system's resolver,
+// which is how headless services & compose services are discovered.
+func platformDiscovery(conf privnet.DiscoveryConfig) *privnet.CachedDiscovery {
+	dns := privnet.NewDNSDiscovery("", "", nil)
+	dns.Queries = conf.QueryOptions()
+	return privnet.NewCachedDiscovery(dns, conf.CacheTTL, conf.MaxStale)
+}
+
+// Logs for platforms that work around failures
+type platformLog struct {
+	logf atomic.Value
+}
+
+func (l *platformLog) SetLogf(logf func(format string, args ...any)) {
+	l.logf.Store(logf)
+}
+
+func (l *platformLog) log(format string, args ...any) {
+	if logf, ok := l.logf.Load().(func(string, ...any)); ok {
+		logf(format, args...)
+	}
+}
+
+// The Fly variables, under their common names
+type flyPlatform struct {
+	platformLog
+}
+
+func (*flyPlatform) Load(ctx context.Context, app string, fly FlyVars) (PlatformVars, error) {
+	vars := PlatformVars{
+		Name:       "fly",
+		App:        fly.AppName,
+		InstanceID: fly.MachineID,
+		Hostname:   hostname(),
+		Region:     fly.Region,
+		IP:         fly.IP,
+		Meta: map[string]string{
+			"image_ref":      fly.ImageRef,
+			"primary_region": fly.PrimaryRegion,
+			"process_group":  fly.ProcessGroup,
+			"public_ip":      fly.PublicIP,
+		},
+	}
+	for _, peer := range fly.Peers {
+		vars.Peers = append(vars.Peers, PlatformPeer{ID: peer.AllocID, Region: peer.Region, IP: peer.IP, Host: peer.Host})
+	}
+	return vars, nil
+}
+
+// A pod, described by the downward API's environment variables (POD_NAME,
+// POD_NAMESPACE, POD_IP & NODE_NAME) and files (labels & annotations). Its
+// peers are the addresses of the app's headless service.
+type kubernetesPlatform struct {
+	platformLog
+	podinfo string
+	disc    *privnet.CachedDiscovery
+}
+
+func (k *kubernetesPlatform) SetLogf(logf func(format string, args ...any)) {
+	k.platformLog.SetLogf(logf)
+	k.disc.SetLogf(logf)
+}
+
+func (k *kubernetesPlatform) Load(ctx context.Context, app string, fly FlyVars) (PlatformVars, error) {
+	vars := PlatformVars{
+		Name:       "kubernetes",
+		App:        app,
+		InstanceID: getenv("POD_NAME", hostname()),
+		Hostname:   hostname(),
+		Region:     getenv("REGION", "local"),
+		IP:         os.Getenv("POD_IP"),
+		Meta: map[string]string{
+			"namespace": k.namespace(),
+			"node":      os.Getenv("NODE_NAME"),
+		},
+	}
+
+	var err error
+	if vars.Labels, err = readPodinfo(filepath.Join(k.podinfo, "labels")); err != nil {
+		return vars, err
+	}
+	annotations, err := readPodinfo(filepath.Join(k.podinfo, "annotations"))
+	if err != nil {
+		return vars, err
+	}
+	for key, value := range annotations {
+		vars.Meta["annotation."+key] = value
+	}
+
+	if vars.IP == "" {
+		vars.IP = localIP(ctx, vars.Hostname)
+	}
+	self := PlatformPeer{ID: vars.InstanceID, Region: vars.Region, IP: vars.IP, Host: vars.Hostname}
+	if app == "" {
+		vars.Peers = []PlatformPeer{self}
+		return vars, nil
+	}
+
+	service := fmt.Sprintf("%s.%s.svc.%s", app, vars.Meta["namespace"], getenv("CLUSTER_DOMAIN", "cluster.local"))
+	vars.Peers = dnsPeers(ctx, k.disc, service, self, k.log)
+	return vars, nil
+}
+
+func (k *kubernetesPlatform) namespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if ns, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "default"
+}
+
+// A container, whose peers are the addresses of its compose service
+type dockerPlatform struct {
+	platformLog
+	disc *privnet.CachedDiscovery
+}
+
+func (d *dockerPlatform) SetLogf(logf func(format string, args ...any)) {
+	d.platformLog.SetLogf(logf)
+	d.disc.SetLogf(logf)
+}
+
+func (d *dockerPlatform) Load(ctx context.Context, app string, fly FlyVars) (PlatformVars, error) {
+	vars := PlatformVars{
+		Name:       "docker",
+		App:        app,
+		InstanceID: hostname(),
+		Hostname:   hostname(),
+		Region:     getenv("REGION", "local"),
+	}
+	vars.IP = localIP(ctx, vars.Hostname)
+
+	self := PlatformPeer{ID: vars.InstanceID, Region: vars.Region, IP: vars.IP, Host: vars.Hostname}
+	if app == "" {
+		vars.Peers = []PlatformPeer{self}
+		return vars, nil
+	}
+
+	vars.Peers = dnsPeers(ctx, d.disc, app, self, d.log)
+	return vars, nil
+}
+
+// A machine on its own
+type hostPlatform struct {
+	platformLog
+}
+
+func (*hostPlatform) Load(ctx context.Context, app string, fly FlyVars) (PlatformVars, error) {
+	vars := PlatformVars{
+		Name:       "host",
+		App:        app,
+		InstanceID: hostname(),
+		Hostname:   hostname(),
+		Region:     getenv("REGION", "local"),
+		IP:         interfaceIP(),
+	}
+	vars.Peers = []PlatformPeer{{ID: vars.InstanceID, Region: vars.Region, IP: vars.IP, Host: vars.Hostname}}
+	return vars, nil
+}
+
+// The addresses that name resolves to, as peers, including self. Peers
+// are best-effort: if they can't be looked up, self is the only one.
+func dnsPeers(ctx context.Context, disc privnet.Discovery, name string, self PlatformPeer, logf func(format string, args ...any)) []PlatformPeer {
+	found, err := disc.Peers(ctx, name)
+	if err != nil {
+		logf("Unable to look up the platform's peers, using only this instance: %s", err)
+		return []PlatformPeer{self}
+	}
+
+	peers := make([]PlatformPeer, 0, len(found)+1)
+	var hasSelf bool
+	for _, peer := range found {
+		ip := peer.IP.String()
+		if ip == self.IP {
+			hasSelf = true
+			peers = append(peers, self)
+			continue
+		}
+		peers = append(peers, PlatformPeer{ID: ip, Region: self.Region, IP: ip, Host: ip})
+	}
+	if !hasSelf {
+		peers = append(peers, self)
+	}
+	return peers
+}
+
+// Read a downward API file of key="value" lines. A missing file is empty.
+func readPodinfo(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// The address the hostname resolves to, as in containers' /etc/hosts
+func localIP(ctx context.Context, host string) string {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return interfaceIP()
+	}
+	return addrs[0].IP.String()
+}
+
+// The first address that isn't loopback or link local, preferring IPv4
+func interfaceIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+
+	var v6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		} else if v6 == "" {
+			v6 = ipnet.IP.String()
+		}
+	}
+	if v6 != "" {
+		return v6
+	}
+	return "127.0.0.1"
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,134 @@
+package render_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maidata/procfly/internal/privnet"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestDetectPlatform(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "")
+	t.Setenv("FLY_ALLOC_ID", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	if got := render.DetectPlatform(); got != "kubernetes" {
+		t.Errorf("with KUBERNETES_SERVICE_HOST, got %q", got)
+	}
+
+	t.Setenv("FLY_APP_NAME", "nats")
+	if got := render.DetectPlatform(); got != "fly" {
+		t.Errorf("with FLY_APP_NAME, got %q", got)
+	}
+
+	if _, err := render.OpenPlatform("nomad", privnet.DiscoveryConfig{}); !errors.Is(err, render.ErrUnknownPlatform) {
+		t.Errorf("opening an unknown platform, got %v", err)
+	}
+}
+
+func TestFlyPlatform(t *testing.T) {
+	platform, err := render.OpenPlatform("fly", privnet.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := platform.Load(context.Background(), "nats", render.FlyVars{
+		AppName:   "nats",
+		MachineID: "2f9a13b7c1d2e3",
+		Region:    "lhr",
+		IP:        "fdaa:0:1::2",
+		Peers: []render.FlyPeer{
+			{AllocID: "2f9a13b7c1d2e3", Region: "lhr", IP: "fdaa:0:1::2", Host: "2f9a13b7c1d2e3.vm.nats.internal"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vars.Name != "fly" || vars.App != "nats" || vars.InstanceID != "2f9a13b7c1d2e3" || vars.Region != "lhr" || vars.IP != "fdaa:0:1::2" {
+		t.Errorf("unexpected vars %+v", vars)
+	}
+	want := []render.PlatformPeer{{ID: "2f9a13b7c1d2e3", Region: "lhr", IP: "fdaa:0:1::2", Host: "2f9a13b7c1d2e3.vm.nats.internal"}}
+	if !reflect.DeepEqual(vars.Peers, want) {
+		t.Errorf("expected peers %+v, got %+v", want, vars.Peers)
+	}
+}
+
+func TestKubernetesPlatform(t *testing.T) {
+	podinfo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(podinfo, "labels"), []byte("app=\"nats\"\ntier=\"queue\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROCFLY_PODINFO_DIR", podinfo)
+	t.Setenv("POD_NAME", "nats-0")
+	t.Setenv("POD_NAMESPACE", "queues")
+	t.Setenv("POD_IP", "10.1.2.3")
+	t.Setenv("NODE_NAME", "node-a")
+	t.Setenv("REGION", "")
+
+	platform, err := render.OpenPlatform("kubernetes", privnet.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an app, there's no service to look up
+	vars, err := platform.Load(context.Background(), "", render.FlyVars{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vars.InstanceID != "nats-0" || vars.IP != "10.1.2.3" || vars.Region != "local" {
+		t.Errorf("unexpected vars %+v", vars)
+	}
+	if vars.Meta["namespace"] != "queues" || vars.Meta["node"] != "node-a" {
+		t.Errorf("unexpected meta %v", vars.Meta)
+	}
+	if want := map[string]string{"app": "nats", "tier": "queue"}; !reflect.DeepEqual(vars.Labels, want) {
+		t.Errorf("expected labels %v, got %v", want, vars.Labels)
+	}
+	if len(vars.Peers) != 1 || vars.Peers[0].ID != "nats-0" {
+		t.Errorf("expected only itself as a peer, got %+v", vars.Peers)
+	}
+	// Peers that can't be looked up are logged, leaving only itself
+	timeout, retries := 100*time.Millisecond, 0
+	platform, err = render.OpenPlatform("kubernetes", privnet.DiscoveryConfig{Timeout: &timeout, Retries: &retries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []string
+	platform.SetLogf(func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	})
+	vars, err = platform.Load(context.Background(), "missing.invalid", render.FlyVars{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars.Peers) != 1 || vars.Peers[0].ID != "nats-0" {
+		t.Errorf("expected only itself as a peer, got %+v", vars.Peers)
+	}
+	if len(logs) != 1 {
+		t.Errorf("expected the failed lookup to be logged, got %q", logs)
+	}
+}
+
+func TestHostPlatform(t *testing.T) {
+	t.Setenv("REGION", "home")
+	platform, err := render.OpenPlatform("host", privnet.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := platform.Load(context.Background(), "nats", render.FlyVars{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Name != "host" || vars.App != "nats" || vars.Region != "home" || vars.IP == "" || len(vars.Peers) != 1 {
+		t.Errorf("unexpected vars %+v", vars)
+	}
+}
@@ -0,0 +1,128 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/util"
+)
+
+// Where secrets are loaded from. Later sources override earlier
+// ones, in the order env prefix, directory, dotenv file.
+type SecretSources struct {
+	// Environment variables with this prefix are secrets,
+	// named without the prefix
+	EnvPrefix string `yaml:"env_prefix"`
+	// Each file in this directory is a secret, named after the
+	// file. A trailing newline is removed from its content.
+	Dir string `yaml:"dir"`
+	// A file of KEY=value lines
+	DotEnv string `yaml:"dotenv"`
+}
+
+type SecretVars map[string]string
+
+// The secrets' values, which should be redacted from output
+func (s SecretVars) Values() []string {
+	values := make([]string, 0, len(s))
+	for _, name := range util.StableIter(s) {
+		values = append(values, s[name])
+	}
+	return values
+}
+
+// Load the secrets from each of the configured sources. Paths
+// are relative to the root directory.
+func LoadSecrets(paths file.Paths, sources SecretSources) (SecretVars, error) {
+	secrets := make(SecretVars)
+
+	if sources.EnvPrefix != "" {
+		for _, entry := range os.Environ() {
+			key, value, _ := strings.Cut(entry, "=")
+			if name := strings.TrimPrefix(key, sources.EnvPrefix); name != key && name != "" {
+				secrets[name] = value
+			}
+		}
+	}
+
+	if sources.Dir != "" {
+		entries, err := os.ReadDir(paths.Resolve(sources.Dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// Skips the ..data links that Kubernetes creates
+			// in mounted secret volumes
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(paths.Resolve(sources.Dir), entry.Name())
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			content = bytes.TrimSuffix(content, []byte("\n"))
+			secrets[entry.Name()] = string(bytes.TrimSuffix(content, []byte("\r")))
+		}
+	}
+
+	if sources.DotEnv != "" {
+		content, err := paths.Read(sources.DotEnv)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseDotEnv(content, secrets); err != nil {
+			return nil, fmt.Errorf("%s: %w", sources.DotEnv, err)
+		}
+	}
+
+	return secrets, nil
+}
+
+// Parse KEY=value lines, as written for docker & compose. Lines may start
+// with export, values may be single or double quoted, and anything after
+// a # in an unquoted value is a comment.
+func parseDotEnv(content []byte, vars map[string]string) error {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("line %d: expected KEY=value", n)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		vars[key] = value
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,72 @@
+package render_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/render"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	t.Setenv("PROCFLY_SECRET_TOKEN", "from-env")
+	t.Setenv("PROCFLY_SECRET_PASSWORD", "overridden")
+
+	for name, content := range map[string]string{
+		"secrets/PASSWORD": "from-dir\n",
+		"secrets/..data":   "ignored",
+		".env": `# A comment
+export API_KEY=abc123 # trailing comment
+QUOTED="line\nbreak"
+SINGLE='it''s # literal'
+`,
+	} {
+		path := filepath.Join(paths.RootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secrets, err := render.LoadSecrets(paths, render.SecretSources{
+		EnvPrefix: "PROCFLY_SECRET_",
+		Dir:       "secrets",
+		DotEnv:    ".env",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := render.SecretVars{
+		"TOKEN":    "from-env",
+		"PASSWORD": "from-dir",
+		"API_KEY":  "abc123",
+		"QUOTED":   "line\nbreak",
+		"SINGLE":   "it''s # literal",
+	}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("expected %v, got %v", want, secrets)
+	}
+}
+
+func TestSecretRedaction(t *testing.T) {
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), nil)
+	rndr.SetSecrets(render.SecretVars{"PASSWORD": "hunter22"})
+
+	cmd, err := rndr.Command(`nats-server --pass {{ secret "PASSWORD" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rndr.Redact(cmd.String()); got != "nats-server --pass [redacted]" {
+		t.Errorf("unexpected redacted command: %q", got)
+	}
+
+	if _, err := rndr.Command(`{{ secret "MISSING" }}`); err == nil {
+		t.Error("expected an error for a missing secret")
+	}
+}
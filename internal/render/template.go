@@ -2,50 +2,261 @@ package render
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"hash"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/privnet"
 	"github.com/maidata/procfly/internal/process"
 	"github.com/maidata/procfly/internal/util"
+	"gopkg.in/yaml.v3"
 )
 
-var templates = make(map[string]*template.Template)
+var ErrCheckFailed = errors.New("check failed")
 
+// A failure to render a templated file
+type TemplateError struct {
+	// The rendered file
+	Dest string
+	// The template file, if the template isn't inline
+	Source string
+	Err    error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s: %s", e.Dest, e.Err)
+	}
+	return fmt.Sprintf("%s (from %s): %s", e.Dest, e.Source, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// Options shared by inline templates and template files
+type TemplateOptions struct {
+	// Actions to take when the rendered file changes. If there are
+	// none, all reload commands are run.
+	OnChange []process.OnChange `yaml:"on_change"`
+	// The rendered file's permissions. Inline templates
+	// default to 0660, and template files to 0600.
+	Mode file.Mode `yaml:"mode"`
+	// The user & group that own the rendered file, by name or id
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+	// A command that must succeed before a newly rendered file replaces
+	// the old one. It's a template, rendered with CheckVars.
+	Check string `yaml:"check"`
+	// Fail to render if the template uses a missing map key, instead
+	// of rendering "<no value>". Overrides the renderer's default.
+	Strict *bool `yaml:"strict"`
+}
+
+// The variables available to a template's check command
+type CheckVars struct {
+	// The newly rendered file, which is yet to replace the old one
+	Path string
+	// The path the file will be moved to, if the check passes
+	Dest string
+}
+
+// An inline template may be configured with just its
+// template, or with a mapping that includes it.
+type InlineTemplate struct {
+	Template        string `yaml:"template"`
+	TemplateOptions `yaml:",inline"`
+}
+
+func (t *InlineTemplate) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&t.Template)
+	}
+	type plain InlineTemplate
+	return node.Decode((*plain)(t))
+}
+
+// A template file may be configured with just its source
+// path, or with a mapping that includes it.
+//
+// The source may also be a directory, or a glob pattern, in which case the
+// destination is a directory. A directory's files are rendered with the same
+// structure beneath the destination, while the files matching a pattern are
+// rendered directly into it. Any rendered file whose source is later removed
+// is deleted.
+type TemplateFile struct {
+	Source string `yaml:"source"`
+	// A suffix to remove from the names of the files rendered
+	// from a directory or pattern, such as .tmpl
+	StripSuffix     string `yaml:"strip_suffix"`
+	TemplateOptions `yaml:",inline"`
+}
+
+func (t *TemplateFile) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&t.Source)
+	}
+	type plain TemplateFile
+	return node.Decode((*plain)(t))
+}
+
+// A Renderer is safe for concurrent use. Templates are rendered without
+// holding its lock, so that a slow template doesn't hold up the others.
 type Renderer struct {
 	paths file.Paths
-	vars  any
-	hash  hash.Hash
+	// Parsed templates, keyed by a hash of their name, content &
+	// library. They're cached per renderer, as some of their
+	// functions are bound to it.
+	templates *templateCache
+
+	mu     sync.Mutex
+	vars   any
+	hashes map[string]string
+	prev   map[string]string
+	// Files read while rendering
+	sources map[string]bool
+	// Named templates shared by every other template
+	lib     *template.Template
+	libHash string
+	// Whether templates fail on missing map keys by default
+	strict bool
+	// The files rendered from each directory or pattern
+	expanded  map[string][]string
+	secrets   SecretVars
+	redactor  *util.Redactor
+	discovery privnet.Discovery
+	// Apps looked up since the last reset
+	lookups map[string]appLookup
 }
 
 func NewRenderer(paths file.Paths, vars any) *Renderer {
 	return &Renderer{
-		paths: paths,
-		vars:  vars,
-		hash:  sha256.New(),
+		paths:     paths,
+		templates: newTemplateCache(cacheSize),
+		vars:      vars,
+		hashes:    make(map[string]string),
+		sources:   make(map[string]bool),
+		redactor:  util.NewRedactor(),
+		discovery: privnet.NewFlyDNS(""),
+		lookups:   make(map[string]appLookup),
 	}
 }
 
-func (r *Renderer) Hash() string {
-	return hex.EncodeToString(r.hash.Sum(nil))
+// The files read while rendering since the last reset, which
+// should trigger a refresh when they change. Directories & patterns
+// that templates are rendered from add their directories, which
+// should trigger a refresh when files are added to them.
+func (r *Renderer) Sources() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return util.StableIter(r.sources)
+}
+
+// The files whose rendered content has changed between the
+// previous reset and the last one. Files that have been rendered
+// for the first time count as changed.
+func (r *Renderer) Changed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changed []string
+	for _, file := range util.StableIter(r.hashes) {
+		if r.prev[file] != r.hashes[file] {
+			changed = append(changed, file)
+		}
+	}
+	return changed
 }
 
 func (r *Renderer) Reset(vars any) {
-	r.hash = sha256.New()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prev, r.hashes = r.hashes, make(map[string]string)
+	r.sources = make(map[string]bool)
+	r.lookups = make(map[string]appLookup)
 	if vars != nil {
 		r.vars = vars
 	}
 }
 
+// Make templates fail on missing map keys by default,
+// unless their options say otherwise.
+func (r *Renderer) SetStrict(strict bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.strict = strict
+}
+
+// Make the secrets available to the secret function. Their values, and
+// those of any secret that's been set before, are redacted by Redact.
+func (r *Renderer) SetSecrets(secrets SecretVars) {
+	r.redactor.Add(secrets.Values()...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = secrets
+}
+
+// Hide any secret values in the text
+func (r *Renderer) Redact(s string) string {
+	return r.redactor.Redact(s)
+}
+
+// Look up other apps with disc, rather than Fly's DNS
+func (r *Renderer) SetDiscovery(disc privnet.Discovery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.discovery = disc
+	r.lookups = make(map[string]appLookup)
+}
+
+func (r *Renderer) addSource(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[r.paths.Resolve(path)] = true
+}
+
+// Add a directory as a source, if it exists
+func (r *Renderer) addSourceDir(dir string) {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		r.addSource(dir)
+	}
+}
+
+// The deepest directory of a pattern without any wildcards
+func patternDir(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+func (r *Renderer) setHash(dest, hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashes[dest] = hash
+}
+
 func (r *Renderer) Command(tmpl string) (process.Command, error) {
 	buf := new(bytes.Buffer)
 	cmd := new(process.Command)
 
-	if err := r.render(tmpl, false, buf); err != nil {
+	if err := r.Render("command", tmpl, buf); err != nil {
 		return *cmd, err
 	}
 
@@ -56,17 +267,40 @@ func (r *Renderer) Command(tmpl string) (process.Command, error) {
 	return *cmd, nil
 }
 
+// Render a condition, which must be true or false, ignoring surrounding
+// whitespace. An empty condition is true.
+func (r *Renderer) Condition(tmpl string) (bool, error) {
+	if tmpl == "" {
+		return true, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := r.Render("when", tmpl, buf); err != nil {
+		return false, err
+	}
+
+	out := strings.TrimSpace(buf.String())
+	switch out {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected true or false, got %q", out)
+	}
+}
+
 func (r *Renderer) Commands(tmpls map[string]string) (map[string]process.Command, error) {
 	rendered := make(map[string]process.Command)
 	buf := new(bytes.Buffer)
 	cmd := new(process.Command)
 	for name, tmpl := range tmpls {
-		if err := r.render(tmpl, false, buf); err != nil {
-			return nil, err
+		if err := r.Render(name, tmpl, buf); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
 
 		if err := cmd.UnmarshalText(buf.Bytes()); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
 
 		rendered[name] = *cmd
@@ -75,65 +309,347 @@ func (r *Renderer) Commands(tmpls map[string]string) (map[string]process.Command
 	return rendered, nil
 }
 
-func (r *Renderer) InlineTemplates(tmpls map[string]string) error {
+// Render each of the inline templates to its file. A failure to render
+// one file doesn't stop the others from being rendered; all of the
+// failures are returned together, as util.Errors of *TemplateError.
+func (r *Renderer) InlineTemplates(tmpls map[string]InlineTemplate) error {
+	var errs util.Errors
 	for _, file := range util.StableIter(tmpls) {
-		f, err := r.paths.Open(file, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0660)
+		if err := r.renderFile(file, file, tmpls[file].Template, tmpls[file].TemplateOptions, 0660); err != nil {
+			errs = append(errs, &TemplateError{Dest: file, Err: err})
+		}
+	}
+	return errs.Err()
+}
+
+// Render each of the template files to its destination. Like inline
+// templates, all of the failures are returned together.
+func (r *Renderer) TemplateFiles(tmpls map[string]TemplateFile) error {
+	r.mu.Lock()
+	prev := r.expanded
+	r.mu.Unlock()
+
+	var errs util.Errors
+	if prev == nil {
+		var err error
+		if prev, err = r.loadRendered(); err != nil {
+			errs = append(errs, &TemplateError{Dest: r.paths.RenderedFile, Err: err})
+		}
+	}
+
+	expanded := make(map[string][]string)
+	for _, dest := range util.StableIter(tmpls) {
+		files, err := r.Expand(dest, tmpls[dest])
 		if err != nil {
-			return err
+			// Without knowing which files should exist,
+			// none of the previous ones can be removed.
+			expanded[dest] = prev[dest]
+			errs = append(errs, &TemplateError{Dest: dest, Source: tmpls[dest].Source, Err: err})
+			continue
+		}
+		if !isSingleFile(dest, files) {
+			expanded[dest] = util.StableIter(files)
 		}
-		defer f.Close()
 
-		if err := r.render(tmpls[file], true, f); err != nil {
-			return err
+		for _, file := range util.StableIter(files) {
+			src := files[file]
+			r.addSource(src)
+
+			tmpl, err := r.paths.Read(src)
+			if err == nil {
+				err = r.renderFile(file, src, string(tmpl), tmpls[dest].TemplateOptions, 0600)
+			}
+			if err != nil {
+				r.keepPrevious(file)
+				errs = append(errs, &TemplateError{Dest: file, Source: src, Err: err})
+			}
 		}
 	}
-	return nil
+
+	errs = append(errs, r.removeStale(prev, expanded)...)
+	if !reflect.DeepEqual(prev, expanded) {
+		if err := r.saveRendered(expanded); err != nil {
+			errs = append(errs, &TemplateError{Dest: r.paths.RenderedFile, Err: err})
+		}
+	}
+	r.mu.Lock()
+	r.expanded = expanded
+	r.mu.Unlock()
+	return errs.Err()
 }
 
-func (r *Renderer) TemplateFiles(tmpls map[string]string) error {
-	for _, file := range util.StableIter(tmpls) {
-		tmpl, err := r.paths.Read(tmpls[file])
+// The files rendered from each directory or pattern by a previous run,
+// including those whose sources were removed while procfly was stopped.
+func (r *Renderer) loadRendered() (map[string][]string, error) {
+	expanded := make(map[string][]string)
+	if r.paths.RenderedFile == "" {
+		return expanded, nil
+	}
+	data, err := r.paths.Read(r.paths.RenderedFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return expanded, nil
+	} else if err != nil {
+		return expanded, err
+	}
+	if err := json.Unmarshal(data, &expanded); err != nil {
+		return make(map[string][]string), err
+	}
+	return expanded, nil
+}
+
+func (r *Renderer) saveRendered(expanded map[string][]string) error {
+	if r.paths.RenderedFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(expanded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.paths.WriteAtomic(r.paths.RenderedFile, append(data, '\n'), 0600, nil)
+}
+
+// The files to render for a template file, mapping each destination to its
+// source. A source that's neither a directory nor a pattern maps to itself.
+func (r *Renderer) Expand(dest string, tf TemplateFile) (map[string]string, error) {
+	files := make(map[string]string)
+	rename := func(name string) string {
+		return filepath.Join(dest, strings.TrimSuffix(name, tf.StripSuffix))
+	}
+
+	if strings.ContainsAny(tf.Source, "*?[") {
+		matches, err := filepath.Glob(r.paths.Resolve(tf.Source))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		r.addSourceDir(patternDir(r.paths.Resolve(tf.Source)))
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			src := match
+			if !filepath.IsAbs(tf.Source) {
+				if rel, err := filepath.Rel(r.paths.RootDir, match); err == nil {
+					src = rel
+				}
+			}
+			files[rename(filepath.Base(match))] = src
 		}
+		return files, nil
+	}
+
+	root := r.paths.Resolve(tf.Source)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		files[dest] = tf.Source
+		return files, nil
+	}
 
-		f, err := r.paths.Open(file, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		// Hidden files are skipped, along with the ..data links
+		// that Kubernetes creates in mounted volumes.
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			r.addSourceDir(path)
+		}
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
 
-		if err := r.render(string(tmpl), true, f); err != nil {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
 			return err
 		}
+		files[rename(rel)] = filepath.Join(tf.Source, rel)
+		return nil
+	})
+	return files, err
+}
+
+func isSingleFile(dest string, files map[string]string) bool {
+	_, ok := files[dest]
+	return ok && len(files) == 1
+}
+
+// Remove the files previously rendered from a directory or pattern that
+// weren't rendered this time. Removed files count as changed.
+func (r *Renderer) removeStale(prev, expanded map[string][]string) util.Errors {
+	current := make(map[string]bool)
+	for _, files := range expanded {
+		for _, file := range files {
+			current[file] = true
+		}
+	}
+
+	var errs util.Errors
+	for _, dest := range util.StableIter(prev) {
+		for _, file := range prev[dest] {
+			if current[file] {
+				continue
+			}
+			if err := os.Remove(r.paths.Resolve(file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, &TemplateError{Dest: file, Err: err})
+				continue
+			}
+			r.setHash(file, "")
+		}
+	}
+	return errs
+}
+
+// Keep the previous hash of a file that couldn't be rendered. The
+// previous file is still in place, so it shouldn't be reported as
+// changed, either now or once it's successfully rendered again.
+func (r *Renderer) keepPrevious(dest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.prev[dest]; ok {
+		r.hashes[dest] = prev
+	}
+}
+
+// Render a template to a file, hashing its content. The file is only
+// written if it has changed, so that its modification time doesn't churn,
+// and anything watching it isn't disturbed. It's written atomically, so
+// nothing ever sees a partially rendered file.
+func (r *Renderer) renderFile(dest, name, tmpl string, opts TemplateOptions, perm os.FileMode) (err error) {
+	defer func() {
+		if err != nil {
+			r.keepPrevious(dest)
+		}
+	}()
+
+	buf := new(bytes.Buffer)
+	if err := r.RenderWith(name, tmpl, opts, buf); err != nil {
+		return err
+	}
+
+	perm = opts.Mode.Or(perm)
+	uid, err := file.LookupUID(opts.Owner)
+	if err != nil {
+		return err
+	}
+	gid, err := file.LookupGID(opts.Group)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+	if r.unchanged(dest, buf.Bytes(), perm, uid, gid) {
+		r.setHash(dest, hash)
+		return nil
+	}
+
+	err = r.paths.WriteAtomic(dest, buf.Bytes(), perm, func(tmp string) error {
+		if uid >= 0 || gid >= 0 {
+			if err := os.Chown(tmp, uid, gid); err != nil {
+				return err
+			}
+		}
+		if opts.Check != "" {
+			return r.check(opts.Check, tmp, dest)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.setHash(dest, hash)
+	return nil
+}
+
+// Returns true if the file already has the given content and attributes
+func (r *Renderer) unchanged(dest string, content []byte, perm os.FileMode, uid, gid int) bool {
+	info, err := os.Stat(r.paths.Resolve(dest))
+	if err != nil || info.Mode().Perm() != perm.Perm() {
+		return false
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if (uid >= 0 && int(stat.Uid) != uid) || (gid >= 0 && int(stat.Gid) != gid) {
+			return false
+		}
+	}
+
+	current, err := r.paths.Read(dest)
+	return err == nil && bytes.Equal(current, content)
+}
+
+// Run the check command against a newly rendered file
+func (r *Renderer) check(tmpl, tmp, dest string) error {
+	buf := new(bytes.Buffer)
+	vars := CheckVars{Path: tmp, Dest: r.paths.Resolve(dest)}
+	r.mu.Lock()
+	strict := r.strict
+	r.mu.Unlock()
+	if err := r.execute("check", tmpl, strict, vars, buf); err != nil {
+		return err
+	}
+
+	cmd := new(process.Command)
+	if err := cmd.UnmarshalText(buf.Bytes()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if out, err := cmd.ExecContext(ctx).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s: %s: %s", ErrCheckFailed, cmd, err, bytes.TrimSpace(out))
 	}
 	return nil
 }
 
-func (r *Renderer) render(tmpl string, hash bool, file io.Writer) (err error) {
+// Render the template to w, without writing any files
+// or affecting the renderer's hashes.
+// The name is used in error messages.
+func (r *Renderer) Render(name, tmpl string, w io.Writer) error {
+	return r.RenderWith(name, tmpl, TemplateOptions{}, w)
+}
+
+// Render the template to w like Render, with the template's options
+func (r *Renderer) RenderWith(name, tmpl string, opts TemplateOptions, w io.Writer) error {
+	r.mu.Lock()
+	strict, vars := r.strict, r.vars
+	r.mu.Unlock()
+
+	if opts.Strict != nil {
+		strict = *opts.Strict
+	}
+	return r.execute(name, tmpl, strict, vars, w)
+}
+
+func (r *Renderer) execute(name, tmpl string, strict bool, vars any, w io.Writer) (err error) {
+	r.mu.Lock()
+	lib, libHash := r.lib, r.libHash
+	r.mu.Unlock()
+
 	// Deduplicate templates by hashing them
-	name, err := util.Hash(tmpl)
+	key, err := util.Hash(libHash, name, tmpl, strict)
 	if err != nil {
 		return err
 	}
 
-	t, ok := templates[name]
+	t, ok := r.templates.get(key)
 	if !ok {
-		templates[name], err = template.New(name).Funcs(funcs).Parse(tmpl)
+		t, err = r.parse(lib, name, tmpl)
 		if err != nil {
 			return err
 		}
-		t = templates[name]
-	}
-
-	var w io.Writer
-	if hash {
-		w = io.MultiWriter(r.hash, file)
-	} else {
-		w = file
+		if strict {
+			t.Option("missingkey=error")
+		}
+		r.templates.put(key, t)
 	}
 
-	if err := t.Execute(w, r.vars); err != nil {
+	if err := t.Execute(w, vars); err != nil {
 		return err
 	}
 
@@ -0,0 +1,248 @@
+package render_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maidata/procfly/internal/file"
+	"github.com/maidata/procfly/internal/render"
+	"github.com/maidata/procfly/internal/util"
+)
+
+func TestTemplateErrors(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	rndr := render.NewRenderer(paths, map[string]string{"Name": "world"})
+
+	err := rndr.InlineTemplates(map[string]render.InlineTemplate{
+		"a.conf": {Template: "{{ bad }"},
+		"b.conf": {Template: "hello {{ .Name }}"},
+		"c.conf": {Template: "{{ template \"missing\" }}"},
+	})
+
+	var errs util.Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	for i, dest := range []string{"a.conf", "c.conf"} {
+		var terr *render.TemplateError
+		if !errors.As(errs[i], &terr) || terr.Dest != dest {
+			t.Errorf("expected an error for %s, got %v", dest, errs[i])
+		}
+	}
+
+	// The file without errors should still have been rendered
+	if content, err := os.ReadFile(filepath.Join(paths.RootDir, "b.conf")); err != nil {
+		t.Error(err)
+	} else if string(content) != "hello world" {
+		t.Errorf("unexpected content: %q", content)
+	}
+}
+
+func TestTemplateUnchanged(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	rndr := render.NewRenderer(paths, nil)
+	tmpls := map[string]render.InlineTemplate{"a.conf": {Template: "a"}}
+
+	if err := rndr.InlineTemplates(tmpls); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(paths.RootDir, "a.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rndr.Reset(nil)
+	if err := rndr.InlineTemplates(tmpls); err != nil {
+		t.Fatal(err)
+	}
+	if changed := rndr.Changed(); len(changed) != 0 {
+		t.Errorf("unexpected changes: %v", changed)
+	}
+
+	// An unchanged file shouldn't have been replaced
+	if again, err := os.Stat(filepath.Join(paths.RootDir, "a.conf")); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(info, again) {
+		t.Error("file was rewritten")
+	}
+}
+
+func TestTemplateStrict(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	rndr := render.NewRenderer(paths, map[string]any{"Env": map[string]string{}})
+	rndr.SetStrict(true)
+	lax := false
+
+	err := rndr.InlineTemplates(map[string]render.InlineTemplate{
+		"strict.conf": {Template: "port {{ .Env.PORT }}"},
+		"lax.conf": {
+			Template:        "port {{ .Env.PORT }}",
+			TemplateOptions: render.TemplateOptions{Strict: &lax},
+		},
+	})
+
+	var terr *render.TemplateError
+	if !errors.As(err, &terr) || terr.Dest != "strict.conf" {
+		t.Fatalf("expected an error for strict.conf, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"PORT"`) {
+		t.Errorf("expected the error to name the missing key, got %q", msg)
+	}
+	if _, err := os.Stat(filepath.Join(paths.RootDir, "strict.conf")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("strict.conf shouldn't have been written")
+	}
+
+	if content, err := os.ReadFile(filepath.Join(paths.RootDir, "lax.conf")); err != nil {
+		t.Error(err)
+	} else if string(content) != "port <no value>" {
+		t.Errorf("unexpected content: %q", content)
+	}
+}
+
+func TestTemplateDirectories(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	for name, content := range map[string]string{
+		"src/a.conf.tmpl":     "a={{ .A }}",
+		"src/sub/b.conf.tmpl": "b",
+		"src/.hidden":         "hidden",
+		"globbed/c.yml":       "c",
+		"globbed/d.txt":       "d",
+	} {
+		path := filepath.Join(paths.RootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rndr := render.NewRenderer(paths, map[string]string{"A": "1"})
+	tmpls := map[string]render.TemplateFile{
+		"conf.d": {Source: "src", StripSuffix: ".tmpl"},
+		"yml":    {Source: "globbed/*.yml"},
+	}
+	if err := rndr.TemplateFiles(tmpls); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"conf.d/a.conf", "conf.d/sub/b.conf", "yml/c.yml"}
+	if changed := rndr.Changed(); strings.Join(changed, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v to be rendered, got %v", want, changed)
+	}
+	if content, err := os.ReadFile(filepath.Join(paths.RootDir, "conf.d/a.conf")); err != nil {
+		t.Error(err)
+	} else if string(content) != "a=1" {
+		t.Errorf("unexpected content: %q", content)
+	}
+
+	// Files whose source has been removed should be deleted
+	if err := os.Remove(filepath.Join(paths.RootDir, "src/sub/b.conf.tmpl")); err != nil {
+		t.Fatal(err)
+	}
+	rndr.Reset(nil)
+	if err := rndr.TemplateFiles(tmpls); err != nil {
+		t.Fatal(err)
+	}
+	if changed := rndr.Changed(); len(changed) != 1 || changed[0] != "conf.d/sub/b.conf" {
+		t.Errorf("expected the removed file to have changed, got %v", changed)
+	}
+	if _, err := os.Stat(filepath.Join(paths.RootDir, "conf.d/sub/b.conf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file to have been removed, got %v", err)
+	}
+
+	// Including when the source was removed before a restart
+	if err := os.Remove(filepath.Join(paths.RootDir, "globbed/c.yml")); err != nil {
+		t.Fatal(err)
+	}
+	rndr = render.NewRenderer(paths, map[string]string{"A": "1"})
+	if err := rndr.TemplateFiles(tmpls); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.RootDir, "yml/c.yml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file to have been removed after a restart, got %v", err)
+	}
+}
+
+// Run with -race, to check that rendering and refreshing can overlap
+func TestRendererConcurrency(t *testing.T) {
+	paths := file.NewPaths(t.TempDir())
+	if err := os.MkdirAll(filepath.Join(paths.RootDir, "partials"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(paths.RootDir, "partials/name.tmpl"), []byte("{{ .Name }}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rndr := render.NewRenderer(paths, map[string]string{"Name": "a"})
+	if err := rndr.Library(render.DefaultLibrary); err != nil {
+		t.Fatal(err)
+	}
+	tmpls := map[string]render.InlineTemplate{
+		"a.conf": {Template: `{{ include "name" . }}`},
+		"b.conf": {Template: `{{ readFile "partials/name.tmpl" }}`},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch i % 4 {
+				case 0:
+					rndr.Reset(map[string]string{"Name": fmt.Sprint(j)})
+					_ = rndr.Library(render.DefaultLibrary)
+				case 1:
+					_ = rndr.InlineTemplates(tmpls)
+					_ = rndr.Changed()
+				case 2:
+					// Every render parses a new template, to churn the cache
+					tmpl := fmt.Sprintf(`{{ include "name" . }} %d %d`, i, j)
+					if err := rndr.Render("test", tmpl, io.Discard); err != nil {
+						t.Error(err)
+					}
+				case 3:
+					rndr.SetStrict(j%2 == 0)
+					_ = rndr.Sources()
+					if _, err := rndr.Command(`echo {{ .Name }}`); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCondition(t *testing.T) {
+	rndr := render.NewRenderer(file.NewPaths(t.TempDir()), map[string]any{
+		"Fly": map[string]string{"Region": "lhr"},
+		"Env": map[string]string{"PRIMARY_REGION": "lhr"},
+	})
+
+	for tmpl, want := range map[string]bool{
+		"": true,
+		`{{ eq .Fly.Region .Env.PRIMARY_REGION }}`:   true,
+		`{{ ne .Fly.Region .Env.PRIMARY_REGION }}`:   false,
+		` {{ has .Fly.Region (list "ams" "fra") }} `: false,
+		"true": true,
+	} {
+		if got, err := rndr.Condition(tmpl); err != nil || got != want {
+			t.Errorf("%q: expected %t, got %t (%v)", tmpl, want, got, err)
+		}
+	}
+
+	for _, tmpl := range []string{`{{ .Fly.Region }}`, `{{ bad }`} {
+		if _, err := rndr.Condition(tmpl); err == nil {
+			t.Errorf("%q: expected an error", tmpl)
+		}
+	}
+}
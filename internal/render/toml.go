@@ -0,0 +1,141 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/maidata/procfly/internal/util"
+)
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Encodes a dict (or a struct) as a TOML document. The value is converted
+// through JSON first, so json tags are respected. Nulls have no TOML
+// equivalent, and are left out.
+func toTOML(v any) (string, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return "", fmt.Errorf("toToml expects a dict: %w", err)
+	}
+
+	buf := new(strings.Builder)
+	writeTOMLTable(buf, nil, doc)
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func writeTOMLTable(buf *strings.Builder, path []string, table map[string]any) {
+	var tables, arrays []string
+	for _, key := range util.StableIter(table) {
+		switch value := table[key].(type) {
+		case nil:
+		case map[string]any:
+			tables = append(tables, key)
+		case []any:
+			if isTableArray(value) {
+				arrays = append(arrays, key)
+				continue
+			}
+			fmt.Fprintf(buf, "%s = %s\n", tomlKey(key), tomlValue(value))
+		default:
+			fmt.Fprintf(buf, "%s = %s\n", tomlKey(key), tomlValue(value))
+		}
+	}
+
+	for _, key := range tables {
+		sub := append(append([]string(nil), path...), tomlKey(key))
+		fmt.Fprintf(buf, "\n[%s]\n", strings.Join(sub, "."))
+		writeTOMLTable(buf, sub, table[key].(map[string]any))
+	}
+
+	for _, key := range arrays {
+		sub := append(append([]string(nil), path...), tomlKey(key))
+		for _, item := range table[key].([]any) {
+			fmt.Fprintf(buf, "\n[[%s]]\n", strings.Join(sub, "."))
+			writeTOMLTable(buf, sub, item.(map[string]any))
+		}
+	}
+}
+
+// Arrays made up entirely of tables are written as [[array]] sections
+func isTableArray(items []any) bool {
+	for _, item := range items {
+		if _, ok := item.(map[string]any); !ok {
+			return false
+		}
+	}
+	return len(items) > 0
+}
+
+func tomlKey(key string) string {
+	if bareKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return tomlString(v)
+	case json.Number, bool:
+		return fmt.Sprint(v)
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				items = append(items, tomlValue(item))
+			}
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]any:
+		items := make([]string, 0, len(v))
+		for _, key := range util.StableIter(v) {
+			if v[key] != nil {
+				items = append(items, tomlKey(key)+" = "+tomlValue(v[key]))
+			}
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return tomlString(fmt.Sprint(v))
+}
+
+func tomlString(s string) string {
+	buf := new(strings.Builder)
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(buf, `\u%04X`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,30 @@
+package util_test
+
+import (
+	"fmt"
+
+	"github.com/maidata/procfly/internal/util"
+)
+
+func ExampleUnifiedDiff() {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	fmt.Print(util.UnifiedDiff("a/file", "b/file", a, b))
+	fmt.Print(util.UnifiedDiff("a/file", "b/file", a, a))
+
+	// Output:
+	// --- a/file
+	// +++ b/file
+	// @@ -1,5 +1,5 @@
+	//  a
+	// -b
+	// +B
+	//  c
+	//  d
+	//  e
+	// @@ -10,3 +10,4 @@
+	//  j
+	//  k
+	//  l
+	// +m
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Values shorter than this aren't redacted, as they'd
+// mangle too much unrelated text.
+const minRedactLen = 4
+
+const redacted = "[redacted]"
+
+// A Redactor hides secret values in text. It's safe for concurrent use,
+// and a nil Redactor leaves text as-is.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{values: make(map[string]bool)}
+}
+
+// Add values to be redacted. Values are never removed, so a secret that
+// has since been rotated stays hidden.
+func (r *Redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var added bool
+	for _, v := range values {
+		if len(v) >= minRedactLen && !r.values[v] {
+			r.values[v] = true
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+
+	// The longest values are replaced first, in
+	// case one secret contains another.
+	sorted := StableIter(r.values)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, v := range sorted {
+		pairs = append(pairs, v, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
@@ -0,0 +1,15 @@
+package util_test
+
+import (
+	"fmt"
+
+	"github.com/maidata/procfly/internal/util"
+)
+
+func ExampleRedactor() {
+	r := util.NewRedactor()
+	r.Add("hunter2", "hunter2-admin", "abc")
+
+	fmt.Println(r.Redact("nats-server --user admin --pass hunter2-admin --token hunter2 --abc"))
+	// Output: nats-server --user admin --pass [redacted] --token [redacted] --abc
+}
@@ -7,6 +7,9 @@ import (
 
 type Cli struct {
 	Run     cli.RunCmd     `name:"run" cmd:""`
+	Check   cli.CheckCmd   `name:"check" cmd:""`
+	Render  cli.RenderCmd  `name:"render" cmd:""`
+	DevDNS  cli.DevDNSCmd  `name:"dev-dns" cmd:""`
 	Version cli.VersionCmd `name:"version" cmd:""`
 }
 